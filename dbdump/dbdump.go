@@ -0,0 +1,7318 @@
+/* Package dbdump copies MySQL databases between servers, and into archives, with mysqldump */
+package dbdump
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/klauspost/compress/zstd"
+	"github.com/samber/lo"
+)
+
+var VERSION = "dev"
+
+var CONFIG Config
+
+var PRINTER = NewPrinter(os.Stdout)
+
+/*
+Held by the library entry points (Copy, Bulk, Dump...) for a whole run. CONFIG, PRINTER and POOL are
+shared by the package, so runs started concurrently wait for each other instead of mixing their state
+*/
+var RUN_MUTEX sync.Mutex
+
+/* Command line arguments of a run */
+type Options struct {
+	Command           string
+	Source            string
+	Target            string
+	Db                string
+	Use_empty_tables  bool
+	Zip_filename      string
+	Zip_output_folder string
+	Sql_file          string
+	Tmp_dir           string
+	Keep_sql          bool
+	Exclude_db        []string
+	Source_charset    string
+	Top               int
+	Output            string
+	Force             bool
+	Dumper            string
+	Threads           int
+	Format            string
+	Mtime             time.Time
+	Import_sql_mode   *string
+	On_exists         string
+	No_views          bool
+	Views_last        bool
+	Host_overrides    []string
+	Dump_master_data  bool
+	Gtid_purged       string
+	Max_runtime       time.Duration
+	Insert_ignore     bool
+	Replace           bool
+	Quiet             bool
+	Json              bool
+	Only_changed      bool
+	Validate_queries  bool
+	Filter            string
+	Rewrite_definer   *string
+	Rotate            int
+	Fast_load         bool
+	Strict            bool
+	Check_import      bool
+	Retry_db          int
+	Include_system    bool
+	Skip_space_check  bool
+	Flush_logs        bool
+	Lock_mode         string
+	Progress          bool
+	Merge             bool
+	Tables            []string
+	Utc               bool
+	Time_format       string
+	Skip_missing      bool
+	Target_charset    string
+	Target_collation  string
+	Import_fast       bool
+	Print_config      bool
+	Also_zip          bool
+	Skip_schema_pass  bool
+	Truncate_empty    bool
+	Only              []string
+	Archive_comment   string
+	Resume_from       string
+	Allow_empty       bool
+	Explain           bool
+	Missing_tables    []string
+	Zstd_level        int
+	Restore_file      string
+	Webhook           string
+	Webhook_on        string
+	Dry_run           bool
+	Only_create_db    bool
+	Config_files      []string
+	Max_table_size    int64
+	Large_tables      []string
+	Disable_fk_checks bool
+	Post_tags         []string
+	All_post          bool
+	Validate_stream   bool
+	Jobs              int
+	No_tz_utc         bool
+	Tablespaces       bool
+	Exact             bool
+	Label             string
+	Post_dry_run      bool
+	Config_format     string
+	Data_tables       []string
+	Non_data_tables   []string
+	Health_ttl        time.Duration
+	Consistent        bool
+	Pre_results       map[string]string
+}
+
+type Config struct {
+	Servers               []Connection
+	Empty_tables          []string
+	Data_tables           []string
+	Partitions            map[string][]string
+	Exclude_columns       map[string][]string
+	Transactions          [][]string
+	Post_process_queries  []PostProcessQuery
+	Pre_process_queries   []PreProcessQuery
+	Schema_version_table  SchemaVersionTable
+	Compression_ratio     float64
+	Zip_output_folder     string
+	Zip_filename_template string
+	Target_prefix         string
+	Target_suffix         string
+	Target_replace        [][]string
+	Utc                   bool
+	Time_format           string
+}
+
+type SchemaVersionTable struct {
+	Table  string
+	Column string
+}
+
+/* Post-process query of the config, either a plain string or an object with the query and its options */
+type PostProcessQuery struct {
+	Query      string
+	Batch_size int
+	Tags       []string
+}
+
+func (q *PostProcessQuery) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &q.Query); err == nil {
+		return nil
+	}
+
+	type plain PostProcessQuery
+
+	return json.Unmarshal(data, (*plain)(q))
+}
+
+/*
+Post-process queries of a run. With --post-tags, only the queries with one of the tags run, plus the untagged ones with --all-post.
+The {pre:NAME} tokens are replaced with the results of the pre-process queries once they ran
+*/
+func GetPostProcessQueries(opts Options) []PostProcessQuery {
+	queries := CONFIG.Post_process_queries
+
+	if len(opts.Post_tags) > 0 {
+		queries = lo.Filter(queries, func(query PostProcessQuery, index int) bool {
+			if len(query.Tags) == 0 {
+				return opts.All_post
+			}
+
+			return lo.Some(query.Tags, opts.Post_tags)
+		})
+	}
+
+	if len(opts.Pre_results) == 0 {
+		return queries
+	}
+
+	pairs := []string{}
+
+	for name, result := range opts.Pre_results {
+		pairs = append(pairs, fmt.Sprintf("{pre:%s}", name), result)
+	}
+
+	replacer := strings.NewReplacer(pairs...)
+
+	return lo.Map(queries, func(query PostProcessQuery, index int) PostProcessQuery {
+		query.Query = replacer.Replace(query.Query)
+		return query
+	})
+}
+
+/* Read-only query run on the source before the dump, whose result is used by the post-process queries as {pre:Name} */
+type PreProcessQuery struct {
+	Name  string
+	Query string
+}
+
+var PRE_PROCESS_NAME_REGEXP = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+/* Only plain SELECTs are accepted, so nothing can write to or lock the source */
+func ValidatePreProcessQuery(query PreProcessQuery) error {
+	fields := strings.Fields(query.Query)
+
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != "SELECT" {
+		return fmt.Errorf("pre-process query '%s' must be a SELECT", query.Name)
+	}
+
+	for _, keyword := range []string{"INTO", "FOR", "LOCK"} {
+		if FindKeyword(query.Query, keyword) != -1 {
+			return fmt.Errorf("pre-process query '%s' can't use %s, it must only read the source", query.Name, keyword)
+		}
+	}
+
+	return nil
+}
+
+/*
+Runs the pre-process queries on the source database in a read-only transaction, and returns the
+result of each one as sql literals ready to be inserted in a query: 'a', 'b' for a single column, or
+('a', 1), ('b', 2) for several. An empty result is NULL, so IN ({pre:NAME}) stays valid
+*/
+func RunPreProcessQueries(source Connection, dbName string) (map[string]string, error) {
+	db, err := OpenDatabaseConnection(source, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	results := map[string]string{}
+
+	for _, query := range CONFIG.Pre_process_queries {
+		result, err := GetPreProcessResult(tx, query.Query)
+
+		if err != nil {
+			return nil, fmt.Errorf("pre-process query '%s': %w", query.Name, err)
+		}
+
+		results[query.Name] = result
+	}
+
+	return results, nil
+}
+
+func GetPreProcessResult(tx *sql.Tx, query string) (string, error) {
+	rows, err := tx.Query(query)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+
+	if err != nil {
+		return "", err
+	}
+
+	values := make([]sql.RawBytes, len(columnTypes))
+	pointers := make([]any, len(columnTypes))
+
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	literals := []string{}
+
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+
+		if err != nil {
+			return "", err
+		}
+
+		row := make([]string, len(values))
+
+		for i, value := range values {
+			row[i] = QuoteValue(value, columnTypes[i].DatabaseTypeName())
+		}
+
+		if len(row) == 1 {
+			literals = append(literals, row[0])
+		} else {
+			literals = append(literals, fmt.Sprintf("(%s)", strings.Join(row, ", ")))
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if len(literals) == 0 {
+		return "NULL", nil
+	}
+
+	return strings.Join(literals, ", "), nil
+}
+
+/* Pause between the batches of a batched DELETE, so replicas and other sessions can catch up */
+const BATCH_PAUSE = 100 * time.Millisecond
+
+/* Returns the statement run for each batch of a query with Batch_size, failing for anything but a DELETE */
+func GetBatchedQuery(query PostProcessQuery) (string, error) {
+	statement := strings.TrimRight(strings.TrimSpace(query.Query), ";")
+	fields := strings.Fields(statement)
+
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != "DELETE" {
+		return "", ConfigErrorf("%s: only DELETE queries can have a Batch_size", query.Query)
+	}
+
+	return fmt.Sprintf("%s LIMIT %d", statement, query.Batch_size), nil
+}
+
+type Connection struct {
+	Name             string
+	Ip               string
+	Port             int
+	User             string
+	Password         string
+	Defaults_file    string
+	Fallback_ips     []string
+	Read_only        bool
+	Ssh_host         string
+	Password_command string
+	Charset          string
+	Address_family   string
+}
+
+/* Reads user and password from the [client] section of a MySQL option file */
+func ReadOptionFileCredentials(path string) (string, string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer file.Close()
+
+	user := ""
+	password := ""
+	section := ""
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		if section != "client" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+
+		if !found {
+			continue
+		}
+
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		value = strings.Trim(strings.TrimSpace(value), "\"'")
+
+		if key == "user" {
+			user = value
+		} else if key == "password" {
+			password = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	return user, password, nil
+}
+
+func GetPort(connection Connection) int {
+	if connection.Port == 0 {
+		return 3306
+	}
+
+	return connection.Port
+}
+
+/* Applies --host-override NAME=host:port flags to the configured servers */
+func ApplyHostOverrides(opts Options) error {
+	for _, override := range opts.Host_overrides {
+		name, address, found := strings.Cut(override, "=")
+
+		if !found || name == "" || address == "" {
+			return ConfigErrorf("invalid --host-override value '%s', expected NAME=host:port", override)
+		}
+
+		index := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
+			return c.Name == name
+		})
+
+		if index == -1 {
+			return ConfigErrorf("server '%s' of --host-override not found in config file", name)
+		}
+
+		host, port, err := net.SplitHostPort(address)
+
+		if err != nil {
+			CONFIG.Servers[index].Ip = address
+			continue
+		}
+
+		CONFIG.Servers[index].Ip = host
+		CONFIG.Servers[index].Port, err = strconv.Atoi(port)
+
+		if err != nil {
+			return ConfigErrorf("invalid port in --host-override value '%s'", override)
+		}
+	}
+
+	return nil
+}
+
+func GetDSN(connection Connection) (string, error) {
+	user := connection.User
+	password := connection.Password
+
+	if connection.Defaults_file != "" {
+		var err error
+
+		user, password, err = ReadOptionFileCredentials(connection.Defaults_file)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s:%s@%s(%s)/", user, password, GetNetwork(connection), GetAddress(connection)), nil
+}
+
+/* Returns the host:port every connection to the server goes to, with the default port when Port is unset */
+func GetAddress(connection Connection) string {
+	return net.JoinHostPort(connection.Ip, strconv.Itoa(GetPort(connection)))
+}
+
+/* Names the address that was tried, so a wrong Port or host override shows up in the error */
+func GetConnectError(connection Connection, err error) error {
+	return fmt.Errorf("connect to %s failed: %w", GetAddress(connection), err)
+}
+
+/* Network of the driver for the Address_family of a server: tcp picks whatever the resolver returns first */
+func GetNetwork(connection Connection) string {
+	switch connection.Address_family {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+/*
+Returns the host given to mysqldump and mysql with --host. They have no option to choose the address
+family, so with an Address_family other than auto, Ip is resolved here to an address of that family.
+Dumps through Ssh_host keep Ip, since it's resolved on the ssh host
+*/
+func GetCommandHost(connection Connection) string {
+	if connection.Address_family == "" || connection.Address_family == "auto" || connection.Ssh_host != "" || net.ParseIP(connection.Ip) != nil {
+		return connection.Ip
+	}
+
+	ips, err := net.LookupIP(connection.Ip)
+
+	if err != nil {
+		return connection.Ip
+	}
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (connection.Address_family == "ipv4") {
+			return ip.String()
+		}
+	}
+
+	return connection.Ip
+}
+
+/* Opens a connection to the server, or returns the shared one while a pool is active. Release it with CloseConnection */
+func OpenConnection(connection Connection) (*sql.DB, error) {
+	dsn, err := GetDSN(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if POOL != nil {
+		return POOL.Get(dsn)
+	}
+
+	return sql.Open("mysql", dsn)
+}
+
+/* Opens a connection of its own with dbName as default database, for session state like USE or PREPARE */
+func OpenDatabaseConnection(connection Connection, dbName string) (*sql.DB, error) {
+	dsn, err := GetDSN(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.Open("mysql", dsn+url.PathEscape(dbName))
+}
+
+/* Closes a connection from OpenConnection, unless it's shared by the pool */
+func CloseConnection(db *sql.DB) error {
+	if POOL != nil && POOL.Owns(db) {
+		return nil
+	}
+
+	return db.Close()
+}
+
+var POOL *ConnectionPool
+
+/* Shares one *sql.DB per server, so a bulk run doesn't reconnect for every query of every database */
+type ConnectionPool struct {
+	mutex sync.Mutex
+	dbs   map[string]*sql.DB
+}
+
+func NewConnectionPool() *ConnectionPool {
+	return &ConnectionPool{dbs: map[string]*sql.DB{}}
+}
+
+func (p *ConnectionPool) Get(dsn string) (*sql.DB, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if db, ok := p.dbs[dsn]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open("mysql", dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.dbs[dsn] = db
+
+	return db, nil
+}
+
+func (p *ConnectionPool) Owns(db *sql.DB) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return slices.Contains(lo.Values(p.dbs), db)
+}
+
+func (p *ConnectionPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for dsn, db := range p.dbs {
+		db.Close()
+		delete(p.dbs, dsn)
+	}
+}
+
+/* Reports whether two connections point to the same MySQL server */
+func IsSameServer(a Connection, b Connection) bool {
+	return a.Name == b.Name || (a.Ip == b.Ip && GetPort(a) == GetPort(b))
+}
+
+/* Runs a program reading from the source server, through ssh on Ssh_host when it's set */
+func GetSourceCommand(connection Connection, program string, args []string) *exec.Cmd {
+	if connection.Ssh_host == "" {
+		return exec.Command(program, args...)
+	}
+
+	/* ssh joins its arguments into a single remote command line, so every word is quoted */
+	words := []string{ShellQuote(program)}
+
+	for _, arg := range args {
+		words = append(words, ShellQuote(arg))
+	}
+
+	return exec.Command("ssh", "-T", "-o", "BatchMode=yes", connection.Ssh_host, strings.Join(words, " "))
+}
+
+/* Returns the client character set of a connection: its Charset field, utf8mb4 by default */
+func GetCharset(connection Connection) string {
+	if connection.Charset != "" {
+		return connection.Charset
+	}
+
+	return "utf8mb4"
+}
+
+/* Character sets end up in statements like LOAD DATA ... CHARACTER SET, so they are limited to plain names */
+var CHARSET_REGEXP = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+/* Returns the character set the source is dumped with. --source-charset repairs the data of a single run, so it wins */
+func GetDumpCharset(opts Options, source Connection) string {
+	if opts.Source_charset != "" {
+		return opts.Source_charset
+	}
+
+	return GetCharset(source)
+}
+
+/* Quotes a word for a POSIX shell */
+func ShellQuote(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+/* Remembers when each server last answered a ping, so --health-ttl can skip checking it again */
+type HealthCache struct {
+	mutex   sync.Mutex
+	checked map[string]time.Time
+}
+
+func NewHealthCache() *HealthCache {
+	return &HealthCache{checked: map[string]time.Time{}}
+}
+
+/* Reports whether the server answered a ping within the last ttl. A zero ttl always checks again */
+func (c *HealthCache) Fresh(dsn string, ttl time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	checked, ok := c.checked[dsn]
+
+	return ok && ttl > 0 && time.Since(checked) < ttl
+}
+
+func (c *HealthCache) Mark(dsn string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.checked[dsn] = time.Now()
+}
+
+var HEALTH = NewHealthCache()
+
+/*
+Returns the source connection pointing to the first reachable host among Ip and Fallback_ips.
+Hosts that answered within --health-ttl are used without pinging them again; only successful
+checks are remembered, so a host that is down is checked every time
+*/
+func ResolveSourceHost(opts Options, connection Connection) (Connection, error) {
+	/* The source is only reachable from the ssh host, so it can't be checked from here */
+	if connection.Ssh_host != "" {
+		return connection, nil
+	}
+
+	hosts := append([]string{connection.Ip}, connection.Fallback_ips...)
+
+	var lastErr error
+
+	for _, host := range hosts {
+		candidate := connection
+		candidate.Ip = host
+
+		dsn, err := GetDSN(candidate)
+
+		if err != nil {
+			return connection, err
+		}
+
+		if HEALTH.Fresh(dsn, opts.Health_ttl) {
+			lastErr = nil
+		} else {
+			sql, err := sql.Open("mysql", dsn+"?timeout=5s")
+
+			if err != nil {
+				return connection, err
+			}
+
+			lastErr = sql.Ping()
+			sql.Close()
+
+			if lastErr == nil {
+				HEALTH.Mark(dsn)
+			} else {
+				lastErr = GetConnectError(candidate, lastErr)
+			}
+		}
+
+		if lastErr == nil {
+			if len(connection.Fallback_ips) > 0 {
+				PRINTER.Printf("Using source host %s\n", host)
+			}
+
+			return candidate, nil
+		}
+	}
+
+	return connection, fmt.Errorf("no reachable host for source '%s': %w", connection.Name, lastErr)
+}
+
+/* Credential arguments for the MySQL CLI tools. The option file must be the first argument */
+func GetCredentialArgs(connection Connection) []string {
+	if connection.Defaults_file != "" {
+		return []string{fmt.Sprintf("--defaults-extra-file=%s", connection.Defaults_file)}
+	}
+
+	args := []string{fmt.Sprintf("--user=%s", connection.User)}
+
+	if connection.Password != "" {
+		args = append(args, fmt.Sprintf("--password=%s", connection.Password))
+	}
+
+	return args
+}
+
+/* Tables whose rows are copied with a SELECT instead of mysqldump: partitioned and column-filtered tables */
+func GetSelectedTables(opts Options) []string {
+	if !opts.Use_empty_tables {
+		return []string{}
+	}
+
+	tables := lo.Without(lo.Uniq(append(lo.Keys(CONFIG.Partitions), lo.Keys(CONFIG.Exclude_columns)...)), opts.Missing_tables...)
+	slices.Sort(tables)
+
+	if opts.Merge {
+		return lo.Intersect(tables, opts.Tables)
+	}
+
+	return tables
+}
+
+/* Tables excluded from the data pass: empty tables and tables copied with a SELECT */
+func GetSchemaOnlyTables(opts Options) []string {
+	tables := []string{}
+
+	if opts.Use_empty_tables {
+		tables = lo.Without(CONFIG.Empty_tables, opts.Missing_tables...)
+
+		for _, table := range GetSelectedTables(opts) {
+			if !slices.Contains(tables, table) {
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	/* --max-table-size is explicit, so it also applies with -i */
+	for _, table := range opts.Large_tables {
+		if !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+
+	for _, table := range opts.Non_data_tables {
+		if !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+
+	/* A merge must not recreate the tables it leaves alone */
+	if opts.Merge {
+		return lo.Intersect(tables, opts.Tables)
+	}
+
+	return tables
+}
+
+/*
+Returns the schema-only tables recreated by the schema pass. With --skip-schema-pass the empty
+tables are assumed to exist on the target, and only the selected tables, whose rows are copied
+afterwards, are recreated
+*/
+func GetSchemaPassTables(opts Options) []string {
+	if !opts.Skip_schema_pass {
+		return GetSchemaOnlyTables(opts)
+	}
+
+	return GetSelectedTables(opts)
+}
+
+/* Returns the empty tables kept on the target by --skip-schema-pass */
+func GetSkippedSchemaTables(opts Options) []string {
+	return lo.Without(GetSchemaOnlyTables(opts), GetSchemaPassTables(opts)...)
+}
+
+/*
+mysqlpump differs from mysqldump: no lock-tables or tablespace options, --skip-dump-rows
+instead of --no-data, --exclude-tables instead of --ignore-table, and tables in the output
+are always qualified with the database name
+*/
+func GetPumpCommand(opts Options, connection Connection, dbName string, withData bool, ignoredTables []string) *exec.Cmd {
+	args := GetCredentialArgs(connection)
+
+	args = append(args,
+		fmt.Sprintf("--host=%s", GetCommandHost(connection)),
+		fmt.Sprintf("--port=%d", GetPort(connection)),
+		"--max-allowed-packet=2GB",
+		"--single-transaction",
+		"--set-gtid-purged=OFF",
+		"--no-create-db",
+	)
+
+	if opts.Threads > 0 {
+		args = append(args, fmt.Sprintf("--default-parallelism=%d", opts.Threads))
+	}
+
+	if opts.Insert_ignore {
+		args = append(args, "--insert-ignore")
+	} else if opts.Replace {
+		args = append(args, "--replace")
+	}
+
+	args = append(args, fmt.Sprintf("--default-character-set=%s", GetDumpCharset(opts, connection)))
+
+	schemaOnlyTables := GetSchemaOnlyTables(opts)
+
+	if !withData && len(GetSchemaPassTables(opts)) > 0 {
+		args = append(args, "--skip-dump-rows", dbName)
+		args = append(args, GetSchemaPassTables(opts)...)
+	} else {
+		excludedTables := append(slices.Clone(ignoredTables), schemaOnlyTables...)
+
+		if len(excludedTables) > 0 {
+			tables := lo.Map(excludedTables, func(table string, index int) string {
+				return fmt.Sprintf("%s.%s", dbName, table)
+			})
+
+			args = append(args, fmt.Sprintf("--exclude-tables=%s", strings.Join(tables, ",")))
+		}
+
+		args = append(args, dbName)
+	}
+
+	return GetSourceCommand(connection, "mysqlpump", args)
+}
+
+/*
+Returns the mysqldump options of --lock-mode. "transaction" reads a consistent snapshot without
+blocking writers, but only InnoDB tables are consistent. "tables" read-locks the tables of the
+database for the whole dump, so other engines are consistent too. "none" takes no lock at all
+*/
+func GetLockArgs(opts Options) []string {
+	switch opts.Lock_mode {
+	case "tables":
+		return []string{"--lock-tables"}
+	case "none":
+		return []string{"--skip-lock-tables"}
+	default:
+		return []string{"--skip-lock-tables", "--single-transaction"}
+	}
+}
+
+/*
+Global read lock held on a session of the source for --consistent. Every write to the server waits
+until it's released, so the dumps run meanwhile see the same data whatever the table engines
+*/
+type ReadLock struct {
+	db    *sql.DB
+	conn  *sql.Conn
+	start time.Time
+}
+
+func AcquireReadLock(source Connection) (*ReadLock, error) {
+	dsn, err := GetDSN(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	/* The lock belongs to the session, so it must stay on this connection */
+	conn, err := db.Conn(context.Background())
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(context.Background(), "FLUSH TABLES WITH READ LOCK")
+
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+
+	return &ReadLock{db: db, conn: conn, start: time.Now()}, nil
+}
+
+/* Releases the lock, returning for how long writes were blocked. Later calls do nothing */
+func (l *ReadLock) Release() time.Duration {
+	if l == nil || l.conn == nil {
+		return 0
+	}
+
+	l.conn.ExecContext(context.Background(), "UNLOCK TABLES")
+	l.conn.Close()
+	l.db.Close()
+	l.conn = nil
+
+	return time.Since(l.start)
+}
+
+/* Warns when --lock-mode transaction can't give a consistent dump because of non-InnoDB tables */
+func WarnInconsistentLockMode(opts Options, source Connection, dbName string) {
+	if opts.Lock_mode != "transaction" || opts.Consistent {
+		return
+	}
+
+	sql, err := OpenConnection(source)
+
+	if err != nil {
+		return
+	}
+
+	defer CloseConnection(sql)
+
+	var tables int
+
+	err = sql.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE' AND ENGINE <> 'InnoDB'", dbName).Scan(&tables)
+
+	if err == nil && tables > 0 {
+		PRINTER.Printf("  Warning: %s has %d non-InnoDB tables, which --lock-mode transaction doesn't dump consistently. Use --lock-mode tables for a consistent dump\n", dbName, tables)
+	}
+}
+
+/* ignoredTables are left out of the data pass, e.g. views dumped on their own pass */
+func GetDumpCommand(opts Options, connection Connection, dbName string, withData bool, ignoredTables []string) *exec.Cmd {
+	if opts.Dumper == "mysqlpump" {
+		return GetPumpCommand(opts, connection, dbName, withData, ignoredTables)
+	}
+
+	args := GetCredentialArgs(connection)
+
+	args = append(args,
+		fmt.Sprintf("--host=%s", GetCommandHost(connection)),
+		fmt.Sprintf("--port=%d", GetPort(connection)),
+		"--max-allowed-packet=2GB",
+		fmt.Sprintf("--set-gtid-purged=%s", opts.Gtid_purged),
+	)
+
+	args = append(args, GetLockArgs(opts)...)
+
+	charset := GetDumpCharset(opts, connection)
+
+	/* --exact dumps the rows as their stored bytes, binary columns in hex, without any charset conversion */
+	if withData && opts.Exact {
+		charset = "binary"
+		args = append(args, "--hex-blob")
+	}
+
+	args = append(args, fmt.Sprintf("--default-character-set=%s", charset))
+
+	if withData && opts.Dump_master_data {
+		args = append(args, "--master-data=2")
+	}
+
+	/* With --single-transaction the logs are flushed once, under the read lock taken to start the snapshot */
+	if withData && opts.Flush_logs {
+		args = append(args, "--flush-logs")
+	}
+
+	/* TIMESTAMP values are then written in the time zone of the source session instead of UTC */
+	if opts.No_tz_utc || opts.Exact {
+		args = append(args, "--tz-utc=FALSE")
+	}
+
+	if opts.Insert_ignore {
+		args = append(args, "--insert-ignore")
+	} else if opts.Replace {
+		args = append(args, "--replace")
+	}
+
+	args = append(args, dbName)
+
+	schemaOnlyTables := GetSchemaOnlyTables(opts)
+
+	if withData {
+		tables := lo.Map(append(slices.Clone(ignoredTables), schemaOnlyTables...), func(table string, index int) string {
+			return fmt.Sprintf("--ignore-table=%s.%s", dbName, table)
+		})
+
+		args = append(args, tables...)
+	} else if len(GetSchemaPassTables(opts)) > 0 {
+		args = append(args, "--no-data", "--no-create-db")
+
+		/* Reading the tablespaces needs the PROCESS privilege on the source */
+		if !opts.Tablespaces {
+			args = append(args, "--no-tablespaces")
+		}
+
+		args = append(args, "--tables")
+		args = append(args, GetSchemaPassTables(opts)...)
+	}
+
+	return GetSourceCommand(connection, "mysqldump", args)
+}
+
+/* Dumps only the definition of the given views */
+func GetViewsDumpCommand(opts Options, connection Connection, dbName string, views []string) *exec.Cmd {
+	args := GetCredentialArgs(connection)
+
+	args = append(args,
+		fmt.Sprintf("--host=%s", GetCommandHost(connection)),
+		fmt.Sprintf("--port=%d", GetPort(connection)),
+		"--skip-lock-tables",
+		"--single-transaction",
+		"--set-gtid-purged=OFF",
+		fmt.Sprintf("--default-character-set=%s", GetDumpCharset(opts, connection)),
+		"--no-data",
+		"--no-create-db",
+		"--no-tablespaces",
+		dbName,
+		"--tables",
+	)
+
+	args = append(args, views...)
+
+	return GetSourceCommand(connection, "mysqldump", args)
+}
+
+func GetViews(connection Connection, dbName string) ([]string, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	rows, err := sql.Query("SELECT TABLE_NAME FROM information_schema.VIEWS WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME", dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	views := []string{}
+
+	for rows.Next() {
+		var view string
+
+		if err := rows.Scan(&view); err != nil {
+			return nil, err
+		}
+
+		views = append(views, view)
+	}
+
+	return views, rows.Err()
+}
+
+/* Views left out of the data pass because of --no-views or --views-last */
+func GetIgnoredViews(opts Options, connection Connection, dbName string) ([]string, error) {
+	if !opts.No_views && !opts.Views_last {
+		return []string{}, nil
+	}
+
+	return GetViews(connection, dbName)
+}
+
+func GetMysqlCommand(connection Connection, dbName string) *exec.Cmd {
+	args := GetCredentialArgs(connection)
+
+	args = append(args,
+		fmt.Sprintf("--host=%s", GetCommandHost(connection)),
+		fmt.Sprintf("--port=%d", GetPort(connection)),
+		fmt.Sprintf("--database=%s", dbName),
+		"--max-allowed-packet=2GB",
+		"--ssl-mode=DISABLED",
+		"--show-warnings",
+		fmt.Sprintf("--default-character-set=%s", GetCharset(connection)),
+	)
+
+	args = append(args, dbName)
+
+	return exec.Command("mysql", args...)
+}
+
+/*
+Writes progress lines. On a terminal a step is shown while running and rewritten in place
+with its result; otherwise only the result line is printed. Writes are serialized so
+concurrent replications don't corrupt each other's lines
+*/
+type Printer struct {
+	mutex  *sync.Mutex
+	out    io.Writer
+	parent *Printer
+	Plain  bool
+	Quiet  bool
+}
+
+func NewPrinter(file *os.File) *Printer {
+	plain := true
+
+	if info, err := file.Stat(); err == nil {
+		plain = info.Mode()&os.ModeCharDevice == 0
+	}
+
+	return &Printer{mutex: &sync.Mutex{}, out: file, Plain: plain}
+}
+
+/* Returns a printer collecting plain lines until Flush, so a whole block is written at once */
+func (p *Printer) Buffer() *Printer {
+	return &Printer{mutex: p.mutex, out: &bytes.Buffer{}, parent: p, Plain: true, Quiet: p.Quiet}
+}
+
+func (p *Printer) Flush() {
+	buffer, ok := p.out.(*bytes.Buffer)
+
+	if !ok || p.parent == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	io.Copy(p.parent.out, buffer)
+}
+
+func (p *Printer) write(text string) {
+	if p.Quiet {
+		return
+	}
+
+	if p.parent != nil {
+		io.WriteString(p.out, text)
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	io.WriteString(p.out, text)
+}
+
+func (p *Printer) Printf(format string, args ...any) {
+	p.write(fmt.Sprintf(format, args...))
+}
+
+/* Shows a running step, only on a terminal */
+func (p *Printer) Progress(line string) {
+	if !p.Plain {
+		p.write(line)
+	}
+}
+
+/* Prints the final line of a step, replacing its progress line on a terminal */
+func (p *Printer) Result(line string) {
+	if p.Plain {
+		p.write(line + "\n")
+	} else {
+		p.write("\r" + line + "\n")
+	}
+}
+
+type CountingWriter struct {
+	Writer io.Writer
+	Count  int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Count += int64(n)
+
+	return n, err
+}
+
+/* Captures the binlog coordinates written by --master-data at the beginning of a dump */
+var BINLOG_POSITION_REGEXP = regexp.MustCompile(`CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)', (?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+
+/* Captures the table name of the comment mysqldump writes before the schema and rows of each table */
+var TABLE_STRUCTURE_REGEXP = regexp.MustCompile("-- Table structure for table `([^`]+)`")
+
+/* Rewrites the progress line of a step with the table being dumped, from the comments mysqldump writes before each table */
+type TableProgressWriter struct {
+	Label string
+	Total int
+	count int
+	tail  []byte
+}
+
+/* Returns a writer showing the table progress of a dump with --progress on a terminal, or discarding everything */
+func NewTableProgress(opts Options, source Connection, dbName string, label string, ignoredTables []string) io.Writer {
+	if !opts.Progress || PRINTER.Plain || PRINTER.Quiet {
+		return io.Discard
+	}
+
+	tables, err := GetTableSizes(source, dbName)
+
+	if err != nil {
+		return io.Discard
+	}
+
+	ignoredTables = append(slices.Clone(ignoredTables), GetSchemaOnlyTables(opts)...)
+
+	total := lo.CountBy(tables, func(table TableSize) bool {
+		return !slices.Contains(ignoredTables, table.Name)
+	})
+
+	return &TableProgressWriter{Label: label, Total: total}
+}
+
+func (w *TableProgressWriter) Write(p []byte) (int, error) {
+	/* The tail of the previous write keeps comments split between two writes */
+	data := append(w.tail, p...)
+	end := 0
+
+	for _, match := range TABLE_STRUCTURE_REGEXP.FindAllSubmatchIndex(data, -1) {
+		w.count++
+		end = match[1]
+
+		PRINTER.Progress(fmt.Sprintf("\r%s table %d/%d: %s\033[K", w.Label, w.count, w.Total, data[match[2]:match[3]]))
+	}
+
+	rest := data[end:]
+
+	if len(rest) > 256 {
+		rest = rest[len(rest)-256:]
+	}
+
+	w.tail = slices.Clone(rest)
+
+	return len(p), nil
+}
+
+/* Matches the statements creating or filling a table, whose name may be qualified with the database by mysqlpump */
+var IMPORT_STATEMENT_REGEXP = regexp.MustCompile("^(CREATE TABLE|INSERT|REPLACE)[^`]*(?:`[^`]+`\\.)?`([^`]+)`")
+
+/*
+Counts the CREATE TABLE, INSERT and REPLACE statements sent to an import, with the tables they
+create and fill. mysqldump starts every statement on its own line, so only line starts are read
+*/
+type ImportCounter struct {
+	Statements int
+	Created    []string
+	Filled     []string
+	line       []byte
+}
+
+func (c *ImportCounter) Write(p []byte) (int, error) {
+	data := append(c.line, p...)
+
+	for {
+		end := bytes.IndexByte(data, '\n')
+
+		if end == -1 {
+			break
+		}
+
+		c.count(data[:end])
+		data = data[end+1:]
+	}
+
+	/* The start of an unfinished line is enough to match it, long INSERTs are not kept whole */
+	if len(data) > 256 {
+		data = data[:256]
+	}
+
+	c.line = slices.Clone(data)
+
+	return len(p), nil
+}
+
+func (c *ImportCounter) count(line []byte) {
+	match := IMPORT_STATEMENT_REGEXP.FindSubmatch(line)
+
+	if match == nil {
+		return
+	}
+
+	c.Statements++
+	table := string(match[2])
+
+	if string(match[1]) == "CREATE TABLE" {
+		if !slices.Contains(c.Created, table) {
+			c.Created = append(c.Created, table)
+		}
+	} else if !slices.Contains(c.Filled, table) {
+		c.Filled = append(c.Filled, table)
+	}
+}
+
+/*
+Returns the tables of an import that look partially loaded: created by the stream but missing on
+the target, or filled by the stream but left without rows
+*/
+func CheckImportedTables(target Connection, targetDB string, counter *ImportCounter) ([]string, error) {
+	sql, err := OpenDatabaseConnection(target, targetDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer sql.Close()
+
+	rows, err := sql.Query("SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?", targetDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	existing := []string{}
+
+	for rows.Next() {
+		var table string
+
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+
+		existing = append(existing, table)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	suspect := []string{}
+
+	for _, table := range counter.Created {
+		if !slices.Contains(existing, table) {
+			suspect = append(suspect, fmt.Sprintf("%s (missing)", table))
+		}
+	}
+
+	for _, table := range counter.Filled {
+		if !slices.Contains(existing, table) {
+			if !slices.Contains(counter.Created, table) {
+				suspect = append(suspect, fmt.Sprintf("%s (missing)", table))
+			}
+
+			continue
+		}
+
+		var filled bool
+
+		err = sql.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s)", QuoteIdentifier(table))).Scan(&filled)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !filled {
+			suspect = append(suspect, fmt.Sprintf("%s (no rows)", table))
+		}
+	}
+
+	return suspect, nil
+}
+
+var DEFINER_REGEXP = regexp.MustCompile("DEFINER=`[^`]*`@`[^`]*`")
+
+/*
+Rewrites the DEFINER clauses of views, triggers and routines in a dump stream, or strips them
+when the definer is empty. Data lines are passed through untouched
+*/
+type DefinerRewriter struct {
+	reader  *bufio.Reader
+	definer string
+	pending []byte
+	err     error
+}
+
+func NewDefinerRewriter(reader io.Reader, definer string) *DefinerRewriter {
+	return &DefinerRewriter{reader: bufio.NewReaderSize(reader, 64*1024), definer: FormatDefiner(definer)}
+}
+
+/* Formats USER or USER@HOST as a quoted account. The host defaults to % */
+func FormatDefiner(definer string) string {
+	if definer == "" || strings.EqualFold(definer, "CURRENT_USER") {
+		return definer
+	}
+
+	user, host := definer, "%"
+
+	if index := strings.LastIndex(definer, "@"); index >= 0 {
+		user, host = definer[:index], definer[index+1:]
+	}
+
+	return fmt.Sprintf("%s@%s", QuoteIdentifier(user), QuoteIdentifier(host))
+}
+
+func (r *DefinerRewriter) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		line, err := r.reader.ReadBytes('\n')
+		r.err = err
+
+		if !bytes.HasPrefix(line, []byte("INSERT INTO")) && bytes.Contains(line, []byte("DEFINER=")) {
+			replacement := ""
+
+			if r.definer != "" {
+				replacement = "DEFINER=" + r.definer
+			}
+
+			line = DEFINER_REGEXP.ReplaceAllLiteral(line, []byte(replacement))
+		}
+
+		r.pending = line
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+type BinlogPositionWriter struct {
+	head     []byte
+	Position string
+}
+
+func (w *BinlogPositionWriter) Write(p []byte) (int, error) {
+	if w.Position == "" && len(w.head) < 64*1024 {
+		w.head = append(w.head, p...)
+
+		if match := BINLOG_POSITION_REGEXP.FindSubmatch(w.head); match != nil {
+			w.Position = fmt.Sprintf("%s:%s", match[1], match[2])
+			w.head = nil
+		}
+	}
+
+	return len(p), nil
+}
+
+type ReplicationStats struct {
+	Bytes    int64
+	Tables   int64
+	Rows     int64
+	Warnings int
+}
+
+/* Starts and waits for external programs. Tests can provide a fake that records the arguments and writes canned output */
+type CommandRunner interface {
+	Start(cmd *exec.Cmd) error
+	Wait(cmd *exec.Cmd) error
+}
+
+type ExecRunner struct{}
+
+func (ExecRunner) Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func (ExecRunner) Wait(cmd *exec.Cmd) error {
+	return cmd.Wait()
+}
+
+/* Runs the replication steps that spawn mysqldump and mysql through its Runner */
+type Replicator struct {
+	Runner      CommandRunner
+	Warnings    *ImportWarnings
+	Archive     *os.File
+	Versions    *VersionReport
+	Checkpoints *TableCheckpoints
+	Imports     *ImportCounter
+}
+
+/* Returns where the output of an import goes, collecting its warnings when a replication is running */
+func (r *Replicator) ImportOutput() io.Writer {
+	if r.Warnings == nil {
+		return os.Stdout
+	}
+
+	return r.Warnings
+}
+
+/*
+Collects the warnings and errors printed by mysql --show-warnings while importing, keeping a
+few samples. Any other line is passed through to Out
+*/
+type ImportWarnings struct {
+	Out        io.Writer
+	Count      int
+	Samples    []string
+	Checkpoint func(table string)
+	partial    []byte
+	checkpoint bool
+	mutex      sync.Mutex
+}
+
+func (w *ImportWarnings) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partial = append(w.partial, p...)
+
+	for {
+		index := bytes.IndexByte(w.partial, '\n')
+
+		if index < 0 {
+			break
+		}
+
+		line := string(w.partial[:index])
+		w.partial = w.partial[index+1:]
+
+		/* Printed by the client itself on every run */
+		if strings.Contains(line, "Using a password on the command line interface can be insecure") {
+			continue
+		}
+
+		/* The checkpoint statements print their column name and then the table */
+		if w.checkpoint {
+			w.checkpoint = false
+			w.Checkpoint(line)
+			continue
+		}
+
+		if line == CHECKPOINT_COLUMN && w.Checkpoint != nil {
+			w.checkpoint = true
+			continue
+		}
+
+		if strings.HasPrefix(line, "Warning") || strings.HasPrefix(line, "ERROR") {
+			w.Count++
+
+			if len(w.Samples) < 5 {
+				w.Samples = append(w.Samples, line)
+			}
+
+			continue
+		}
+
+		io.WriteString(w.Out, line+"\n")
+	}
+
+	return len(p), nil
+}
+
+/* Statements sent to the target before the dump stream */
+func GetImportPrelude(opts Options) string {
+	prelude := ""
+
+	if opts.Import_sql_mode != nil {
+		prelude += fmt.Sprintf("SET SESSION sql_mode='%s';\n", strings.ReplaceAll(*opts.Import_sql_mode, "'", "''"))
+	}
+
+	if opts.Import_fast {
+		prelude += "SET autocommit=0;\nSET unique_checks=0;\nSET foreign_key_checks=0;\n"
+	} else if opts.Disable_fk_checks {
+		prelude += "SET foreign_key_checks=0;\n"
+	}
+
+	return prelude
+}
+
+/* Statements sent to the target after the dump stream */
+func GetImportEpilogue(opts Options) string {
+	if opts.Import_fast {
+		return "COMMIT;\nSET unique_checks=1;\nSET foreign_key_checks=1;\nSET autocommit=1;\n"
+	}
+
+	if opts.Disable_fk_checks {
+		return "SET foreign_key_checks=1;\n"
+	}
+
+	return ""
+}
+
+/* Wraps the dump stream with the import prelude and epilogue */
+func GetImportInput(opts Options, input io.Reader) io.Reader {
+	return io.MultiReader(strings.NewReader(GetImportPrelude(opts)), input, strings.NewReader(GetImportEpilogue(opts)))
+}
+
+/*
+Returns the stdin of an import, also copied to the --also-zip file so it holds exactly what was
+applied. The checkpoint statements are added after the copy, so they never reach the archive
+*/
+func (r *Replicator) ImportInput(opts Options, input io.Reader) io.Reader {
+	input = GetImportInput(opts, input)
+
+	if r.Archive != nil {
+		input = io.TeeReader(input, r.Archive)
+	}
+
+	if r.Imports != nil {
+		input = io.TeeReader(input, r.Imports)
+	}
+
+	if r.Checkpoints != nil {
+		input = &CheckpointReader{reader: bufio.NewReader(input), checkpoints: r.Checkpoints}
+	}
+
+	return input
+}
+
+const CHECKPOINT_COLUMN = "dbdump_checkpoint"
+
+/* Progress of the data pass of a database, saved so a failed copy can resume at a table boundary */
+type CopyState struct {
+	Source    string   `json:"source"`
+	Database  string   `json:"database"`
+	Target    string   `json:"target"`
+	Completed []string `json:"completed"`
+	Current   string   `json:"current"`
+}
+
+/* Returns the state file of the copy of a database, in the temp folder */
+func GetStatePath(opts Options, target Connection, targetDB string) string {
+	return filepath.Join(opts.Tmp_dir, fmt.Sprintf("dump_state_%s_%s.json", target.Name, targetDB))
+}
+
+func LoadCopyState(path string) (CopyState, error) {
+	state := CopyState{}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+
+	return state, err
+}
+
+/*
+Reports whether a copy can resume at a table boundary. Checkpoints need the table comments of
+mysqldump, which --fast-load and mysqlpump don't write, --merge and --only-changed pick the tables
+to load on their own, and the commits of the checkpoints would split the single transaction of
+--import-fast
+*/
+func CanResume(opts Options) bool {
+	return opts.Dumper == "mysqldump" && !opts.Fast_load && !opts.Merge && !opts.Only_changed && !opts.Import_fast
+}
+
+/* Progress is only saved when something may resume from it: a --retry-db attempt or a --resume-from run */
+func UsesCheckpoints(opts Options) bool {
+	return CanResume(opts) && (opts.Retry_db > 0 || opts.Resume_from != "")
+}
+
+/* Returns the tables of the saved state that --resume-from doesn't load again */
+func GetResumedTables(opts Options, source Connection, target Connection, sourceDB string, targetDB string) ([]string, error) {
+	path := GetStatePath(opts, target, targetDB)
+
+	state, err := LoadCopyState(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ConfigErrorf("no saved progress in %s to resume %s from", path, targetDB)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Source != source.Name || state.Database != sourceDB {
+		return nil, ConfigErrorf("saved progress in %s is for %s:%s, not %s:%s", path, state.Source, state.Database, source.Name, sourceDB)
+	}
+
+	/* The table to resume from is loaded again even if it was completed */
+	if index := slices.Index(state.Completed, opts.Resume_from); index >= 0 {
+		return state.Completed[:index], nil
+	}
+
+	if state.Current == opts.Resume_from {
+		return state.Completed, nil
+	}
+
+	return nil, ConfigErrorf("table '%s' is not in the saved progress of %s, which stopped at '%s'", opts.Resume_from, targetDB, state.Current)
+}
+
+/*
+Saves the table boundaries of a data pass. A table is started when its schema reaches the import,
+and completed once the target confirms every statement up to the next table was executed
+*/
+type TableCheckpoints struct {
+	Path  string
+	State CopyState
+	mutex sync.Mutex
+}
+
+func (c *TableCheckpoints) Start(table string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.State.Current = table
+	c.save()
+}
+
+func (c *TableCheckpoints) Complete(table string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.State.Completed = append(c.State.Completed, table)
+	c.save()
+}
+
+/* Writes the state through a temporary file, so a crash never leaves it half written. It's best effort and never fails the copy */
+func (c *TableCheckpoints) save() {
+	data, err := json.MarshalIndent(c.State, "", "  ")
+
+	if err != nil {
+		return
+	}
+
+	if os.WriteFile(c.Path+".tmp", data, 0644) == nil {
+		os.Rename(c.Path+".tmp", c.Path)
+	}
+}
+
+/*
+Adds after every table of a dump stream a statement that prints the table name once the target
+has executed it. --import-fast runs never checkpoint, see CanResume
+*/
+type CheckpointReader struct {
+	reader      *bufio.Reader
+	checkpoints *TableCheckpoints
+	pending     []byte
+	table       string
+	done        bool
+}
+
+func (r *CheckpointReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		line, err := r.reader.ReadBytes('\n')
+
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if match := TABLE_STRUCTURE_REGEXP.FindSubmatch(line); match != nil && bytes.HasPrefix(line, []byte("-- Table structure")) {
+			r.pending = append(r.pending, r.statement()...)
+			r.table = string(match[1])
+			r.checkpoints.Start(r.table)
+		}
+
+		r.pending = append(r.pending, line...)
+
+		if err == io.EOF {
+			r.pending = append(r.pending, r.statement()...)
+			r.done = true
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+/* Returns the checkpoint statement of the table in progress, if any */
+func (r *CheckpointReader) statement() string {
+	if r.table == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("\nCOMMIT;\nSELECT %s AS %s;\n", QuoteValue([]byte(r.table), "VARCHAR"), CHECKPOINT_COLUMN)
+}
+
+/*
+Chains the stdout of every command to the stdin of the next one and waits for the last one.
+The returned count is the size of the first command output
+*/
+func (r *Replicator) PipeCommands(opts Options, cmds ...*exec.Cmd) (int64, error) {
+	first := cmds[0]
+	last := cmds[len(cmds)-1]
+
+	pr, pw := io.Pipe()
+
+	counter := &CountingWriter{Writer: pw}
+
+	if first.Stdout != nil {
+		first.Stdout = io.MultiWriter(counter, first.Stdout)
+	} else {
+		first.Stdout = counter
+	}
+
+	input := io.Reader(pr)
+	readers := []*io.PipeReader{pr}
+	writers := []*io.PipeWriter{pw}
+
+	for _, cmd := range cmds[1 : len(cmds)-1] {
+		nextReader, nextWriter := io.Pipe()
+
+		cmd.Stdin = input
+		cmd.Stdout = nextWriter
+
+		input = nextReader
+		readers = append(readers, nextReader)
+		writers = append(writers, nextWriter)
+	}
+
+	if opts.Rewrite_definer != nil {
+		input = NewDefinerRewriter(input, *opts.Rewrite_definer)
+	}
+
+	/* Closed once every command feeding the import has exited, with its error in errs */
+	done := make(chan struct{})
+	errs := make([]error, len(cmds))
+	tails := make([]*TailWriter, len(cmds))
+
+	var stream *ValidatingReader
+
+	if opts.Validate_stream {
+		stream = &ValidatingReader{reader: input, dir: opts.Tmp_dir, wait: func() error {
+			<-done
+
+			for i, err := range errs[:len(cmds)-1] {
+				if err != nil {
+					return GetCommandError(cmds[i], err, tails[i])
+				}
+			}
+
+			return nil
+		}}
+
+		defer stream.Close()
+
+		input = stream
+	}
+
+	last.Stdin = r.ImportInput(opts, input)
+	last.Stdout = r.ImportOutput()
+	last.Stderr = last.Stdout
+
+	/* The end of stderr explains why a command failed */
+	for i, cmd := range cmds {
+		tails[i] = &TailWriter{}
+
+		if cmd.Stderr == nil {
+			cmd.Stderr = tails[i]
+		} else {
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, tails[i])
+		}
+	}
+
+	for _, cmd := range cmds {
+		err := r.Runner.Start(cmd)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var group sync.WaitGroup
+
+	for i, cmd := range cmds[:len(cmds)-1] {
+		group.Add(1)
+
+		go func() {
+			defer group.Done()
+			defer writers[i].Close()
+
+			errs[i] = r.Runner.Wait(cmd)
+		}()
+	}
+
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	errs[len(cmds)-1] = r.Runner.Wait(last)
+
+	/* A failed import stops reading, so the commands feeding it would block forever */
+	if errs[len(cmds)-1] != nil {
+		for _, reader := range readers {
+			reader.Close()
+		}
+
+		for _, cmd := range cmds[:len(cmds)-1] {
+			if cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+		}
+
+		group.Wait()
+
+		/* The import only got an empty stream */
+		if stream != nil && stream.Err != nil {
+			return counter.Count, stream.Err
+		}
+
+		return counter.Count, GetCommandError(last, errs[len(cmds)-1], tails[len(cmds)-1])
+	}
+
+	group.Wait()
+
+	/* A dump dying mid-stream looks like a complete, shorter dump to the import */
+	for i, err := range errs {
+		if err != nil {
+			return counter.Count, GetCommandError(cmds[i], err, tails[i])
+		}
+	}
+
+	return counter.Count, nil
+}
+
+/*
+Buffers a whole dump stream in a temp file before handing it to the import, for --validate-stream. The
+stream is only released when the commands producing it succeeded and it doesn't end inside a statement
+*/
+type ValidatingReader struct {
+	reader io.Reader
+	dir    string
+	wait   func() error
+	file   *os.File
+	Err    error
+}
+
+func (r *ValidatingReader) Read(p []byte) (int, error) {
+	if r.file == nil && r.Err == nil {
+		r.Err = r.buffer()
+	}
+
+	if r.Err != nil {
+		return 0, r.Err
+	}
+
+	return r.file.Read(p)
+}
+
+func (r *ValidatingReader) buffer() error {
+	file, err := os.CreateTemp(r.dir, "dump_stream_*.sql")
+
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	validator := &StatementValidator{}
+
+	_, err = io.Copy(io.MultiWriter(file, validator), r.reader)
+
+	if err != nil {
+		return err
+	}
+
+	err = r.wait()
+
+	if err != nil {
+		return err
+	}
+
+	err = validator.Check()
+
+	if err != nil {
+		return fmt.Errorf("dump looks truncated, nothing was loaded: %w", err)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	return err
+}
+
+func (r *ValidatingReader) Close() {
+	if r.file != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+}
+
+/*
+Splits a sql stream into statements, just enough to tell whether it ends inside a statement, a quoted
+string or a comment. Comments, including the versioned ones mysqldump writes, never end a statement
+*/
+type StatementValidator struct {
+	state   byte
+	prev    byte
+	escaped bool
+	pending bool
+	before  bool
+}
+
+func (v *StatementValidator) Write(p []byte) (int, error) {
+	for _, c := range p {
+		switch v.state {
+		case '\'', '"', '`':
+			if v.escaped {
+				v.escaped = false
+			} else if c == '\\' && v.state != '`' {
+				v.escaped = true
+			} else if c == v.state {
+				v.state = 0
+			}
+		case '#':
+			if c == '\n' {
+				v.state = 0
+			}
+		case '*':
+			if v.prev == '*' && c == '/' {
+				v.state = 0
+				c = 0
+			}
+		case '-':
+			/* -- only starts a comment when followed by whitespace */
+			v.state = 0
+
+			if c == ' ' || c == '\t' || c == '\r' {
+				v.state = '#'
+				v.pending = v.before
+			} else if c == '\n' {
+				v.pending = v.before
+			} else {
+				v.next(c)
+			}
+		default:
+			v.next(c)
+		}
+
+		v.prev = c
+	}
+
+	return len(p), nil
+}
+
+/* Handles a character outside of quotes and comments */
+func (v *StatementValidator) next(c byte) {
+	switch {
+	case c == '\'' || c == '"' || c == '`':
+		v.state = c
+		v.pending = true
+	case c == '#':
+		v.state = '#'
+	case c == '*' && v.prev == '/':
+		v.state = '*'
+		v.pending = v.before
+	case c == '-' && v.prev == '-':
+		v.state = '-'
+	case c == ';':
+		v.pending = false
+	case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+	default:
+		if c == '/' || c == '-' {
+			v.before = v.pending
+		}
+
+		v.pending = true
+	}
+}
+
+/* Returns an error when the stream written so far ends inside a statement, a quoted string or a comment */
+func (v *StatementValidator) Check() error {
+	switch v.state {
+	case '\'', '"', '`':
+		return fmt.Errorf("unterminated %c quote at the end", v.state)
+	case '*':
+		return fmt.Errorf("unterminated comment at the end")
+	}
+
+	if v.pending {
+		return fmt.Errorf("unterminated statement at the end")
+	}
+
+	return nil
+}
+
+/* Keeps the end of what a command writes, to explain its failure */
+type TailWriter struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (w *TailWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.data = append(w.data, p...)
+
+	if len(w.data) > 4096 {
+		w.data = w.data[len(w.data)-4096:]
+	}
+
+	return len(p), nil
+}
+
+/* Returns the last non-empty line written */
+func (w *TailWriter) LastLine() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lines := strings.Split(strings.TrimSpace(string(w.data)), "\n")
+
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+/* Names the failed program and adds the last line of its stderr to its error */
+func GetCommandError(cmd *exec.Cmd, err error, tail *TailWriter) error {
+	if line := tail.LastLine(); line != "" {
+		return fmt.Errorf("%s failed: %w: %s", filepath.Base(cmd.Args[0]), err, line)
+	}
+
+	return fmt.Errorf("%s failed: %w", filepath.Base(cmd.Args[0]), err)
+}
+
+/* Returns the commands piping a dump into mysql, with the --filter program in between */
+func GetPipeline(opts Options, dump *exec.Cmd, mysql *exec.Cmd) []*exec.Cmd {
+	if opts.Filter == "" {
+		return []*exec.Cmd{dump, mysql}
+	}
+
+	return []*exec.Cmd{dump, GetShellCommand(opts.Filter), mysql}
+}
+
+/* Runs a command line through the system shell, so pipes and quoting work as typed */
+func GetShellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("sh", "-c", command)
+}
+
+func FormatBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(bytes)
+	unit := 0
+
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+var SIZE_REGEXP = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)B?$`)
+
+/* Parses a size like 500MB, 2G or 1.5TB, in powers of 1024 as printed by FormatBytes */
+func ParseBytes(value string) (int64, error) {
+	match := SIZE_REGEXP.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+
+	if match == nil {
+		return 0, fmt.Errorf("invalid size '%s', expected a number with an optional KB, MB, GB or TB unit", value)
+	}
+
+	number, err := strconv.ParseFloat(match[1], 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	exponent := strings.Index("KMGT", match[2]) + 1
+
+	if match[2] == "" {
+		exponent = 0
+	}
+
+	return int64(number * math.Pow(1024, float64(exponent))), nil
+}
+
+/*
+Drops the given tables of the target before --merge loads them again, leaving the other tables untouched.
+Foreign key checks are off on the session, so tables referenced by the rest of the database can be dropped
+*/
+func DropTargetTables(db *sql.DB, dbName string, tables []string) error {
+	conn, err := db.Conn(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=0")
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", QuoteIdentifier(dbName), QuoteIdentifier(table)))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=1")
+
+	return err
+}
+
+/* Returns the tables and views of the source left out of a --merge, failing when a merged table doesn't exist */
+func GetUnmergedTables(opts Options, source Connection, sourceDB string) ([]string, error) {
+	tables, err := GetTableSizes(source, sourceDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	views, err := GetViews(source, sourceDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := append(lo.Map(tables, func(table TableSize, index int) string { return table.Name }), views...)
+
+	for _, table := range opts.Tables {
+		if !slices.Contains(names, table) {
+			return nil, ConfigErrorf("table '%s' not found in %s:%s", table, source.Name, sourceDB)
+		}
+	}
+
+	return lo.Without(names, opts.Tables...), nil
+}
+
+/* Empties every base table of an existing database, keeping its schema, views and grants */
+func TruncateTargetDatabase(db *sql.DB, dbName string) error {
+	conn, err := db.Conn(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE'", dbName)
+
+	if err != nil {
+		return err
+	}
+
+	tables := []string{}
+
+	for rows.Next() {
+		var table string
+
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+
+		tables = append(tables, table)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return TruncateTargetTables(conn, dbName, tables)
+}
+
+/* Empties the given tables of an existing database, keeping their schema */
+func TruncateTargetTables(conn *sql.Conn, dbName string, tables []string) error {
+	_, err := conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=0")
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("TRUNCATE TABLE %s.%s", QuoteIdentifier(dbName), QuoteIdentifier(table)))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=1")
+
+	return err
+}
+
+/* Empties the tables whose schema was kept by --skip-schema-pass, with --truncate-empty */
+func TruncateEmptyTables(opts Options, connection Connection, dbName string) error {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return err
+	}
+
+	defer CloseConnection(sql)
+
+	conn, err := sql.Conn(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return TruncateTargetTables(conn, dbName, GetSkippedSchemaTables(opts))
+}
+
+func CreateTargetDatabase(opts Options, connection Connection, dbName string) error {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return err
+	}
+
+	defer CloseConnection(sql)
+
+	/* Only the changed, merged or resumed tables are reloaded, so the rest of the database must survive */
+	if opts.Only_changed || opts.Merge || opts.Resume_from != "" {
+		_, err = sql.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s", dbName, GetDatabaseDefaults(opts)))
+
+		if err != nil || !opts.Merge {
+			return err
+		}
+
+		return DropTargetTables(sql, dbName, opts.Tables)
+	}
+
+	if opts.On_exists != "drop" {
+		var count int
+
+		err = sql.QueryRow("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", dbName).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 && opts.On_exists == "fail" {
+			return fmt.Errorf("target database '%s' already exists on %s", dbName, connection.Name)
+		}
+
+		if count > 0 && opts.On_exists == "truncate" {
+			return TruncateTargetDatabase(sql, dbName)
+		}
+	}
+
+	_, err = sql.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = sql.Exec(fmt.Sprintf("CREATE DATABASE %s%s", dbName, GetDatabaseDefaults(opts)))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/* Returns the CHARACTER SET and COLLATE clauses of --target-charset and --target-collation for CREATE DATABASE */
+func GetDatabaseDefaults(opts Options) string {
+	defaults := ""
+
+	if opts.Target_charset != "" {
+		defaults += fmt.Sprintf(" CHARACTER SET %s", QuoteIdentifier(opts.Target_charset))
+	}
+
+	if opts.Target_collation != "" {
+		defaults += fmt.Sprintf(" COLLATE %s", QuoteIdentifier(opts.Target_collation))
+	}
+
+	return defaults
+}
+
+/* Checks that a database exists on the source and returns its default character set and collation */
+func CheckSourceDatabase(source Connection, dbName string) (string, string, error) {
+	sql, err := OpenConnection(source)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer CloseConnection(sql)
+
+	err = sql.Ping()
+
+	if err != nil {
+		return "", "", GetConnectError(source, err)
+	}
+
+	var count int
+	var charset, collation string
+
+	err = sql.QueryRow("SELECT COUNT(*), COALESCE(MAX(DEFAULT_CHARACTER_SET_NAME), ''), COALESCE(MAX(DEFAULT_COLLATION_NAME), '') FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", dbName).Scan(&count, &charset, &collation)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if count == 0 {
+		return "", "", fmt.Errorf("database %s not found on %s", dbName, source.Name)
+	}
+
+	return charset, collation, nil
+}
+
+/*
+Creates the empty target database for --only-create-db, following --on-exists, and copies nothing. Unless
+--target-charset or --target-collation are given, it keeps the character set and collation of the source database
+*/
+func CreateDatabaseOnly(opts Options, source Connection, target Connection) error {
+	if IsSameServer(source, target) {
+		return ConfigErrorf("refusing to create %s:%s over itself", source.Name, opts.Db)
+	}
+
+	PRINTER.Printf("  %s:%s ━━━▶ %s:%s\n", source.Name, opts.Db, target.Name, opts.Db)
+
+	/* A source behind Ssh_host can't be queried from here */
+	if source.Ssh_host == "" {
+		PRINTER.Progress("  ┗━ Checking source database ...")
+		charset, collation, err := CheckSourceDatabase(source, opts.Db)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking source database ... ✖\n")
+			return err
+		}
+		PRINTER.Result(fmt.Sprintf("  ┣━ Checking source database ... ✔ %s, %s", charset, collation))
+
+		if opts.Target_charset == "" && opts.Target_collation == "" {
+			opts.Target_charset, opts.Target_collation = charset, collation
+		}
+	}
+
+	PRINTER.Progress("  ┗━ Creating target database ...")
+	err := CreateTargetDatabase(opts, target, opts.Db)
+	if err != nil {
+		PRINTER.Result("  ┗━ Creating target database ... ✖\n")
+		return err
+	}
+	PRINTER.Result("  ┣━ Creating target database ... ✔")
+
+	PRINTER.Printf("  ┗━ Done. No data copied\n\n")
+
+	return nil
+}
+
+/* Checks that --target-charset and --target-collation exist on the target and match each other, before anything is dropped */
+func CheckTargetCollation(opts Options, target Connection) error {
+	if opts.Target_charset == "" && opts.Target_collation == "" {
+		return nil
+	}
+
+	sql, err := OpenConnection(target)
+
+	if err != nil {
+		return err
+	}
+
+	defer CloseConnection(sql)
+
+	var count int
+
+	if opts.Target_charset != "" {
+		err = sql.QueryRow("SELECT COUNT(*) FROM information_schema.CHARACTER_SETS WHERE CHARACTER_SET_NAME = ?", opts.Target_charset).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return ConfigErrorf("character set '%s' doesn't exist on %s", opts.Target_charset, target.Name)
+		}
+	}
+
+	if opts.Target_collation != "" {
+		var charset string
+
+		err = sql.QueryRow("SELECT COUNT(*), COALESCE(MAX(CHARACTER_SET_NAME), '') FROM information_schema.COLLATIONS WHERE COLLATION_NAME = ?", opts.Target_collation).Scan(&count, &charset)
+
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return ConfigErrorf("collation '%s' doesn't exist on %s", opts.Target_collation, target.Name)
+		}
+
+		if opts.Target_charset != "" && !strings.EqualFold(charset, opts.Target_charset) {
+			return ConfigErrorf("collation '%s' belongs to character set '%s', not '%s'", opts.Target_collation, charset, opts.Target_charset)
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) ReplicateTablesWithData(opts Options, source Connection, target Connection, sourceDB string, targetDB string, skippedTables []string) (int64, string, error) {
+	views, err := GetIgnoredViews(opts, source, sourceDB)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	c1 := GetDumpCommand(opts, source, sourceDB, true, append(views, skippedTables...))
+	c2 := GetMysqlCommand(target, targetDB)
+
+	position := &BinlogPositionWriter{}
+	progress := NewTableProgress(opts, source, sourceDB, "  ┗━ Replicating tables with data ...", append(views, skippedTables...))
+
+	c1.Stdout = io.MultiWriter(position, progress)
+
+	bytes, err := r.PipeCommands(opts, GetPipeline(opts, c1, c2)...)
+
+	if err != nil {
+		return bytes, position.Position, err
+	}
+
+	return bytes, position.Position, nil
+}
+
+/*
+Dumps the tables with data with --tab into a folder shared with the source server, which writes
+a .sql schema file and a .txt data file per table, then creates the tables and loads the data
+files in parallel with LOAD DATA LOCAL INFILE. Much faster than replaying INSERT statements
+*/
+func (r *Replicator) FastLoadTablesWithData(opts Options, source Connection, target Connection, sourceDB string, targetDB string, skippedTables []string) (int64, error) {
+	if source.Ssh_host != "" {
+		return 0, ConfigErrorf("--fast-load can't be used with a source behind Ssh_host")
+	}
+
+	views, err := GetIgnoredViews(opts, source, sourceDB)
+
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := os.MkdirTemp(opts.Tmp_dir, "dump_tab_")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if !opts.Keep_sql {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	/* The data files are written by the MySQL server, not by mysqldump */
+	err = os.Chmod(dir, 0777)
+
+	if err != nil {
+		return 0, err
+	}
+
+	dump := GetDumpCommand(opts, source, sourceDB, true, append(views, skippedTables...))
+	dump.Args = append(dump.Args, fmt.Sprintf("--tab=%s", dir))
+
+	err = r.Runner.Start(dump)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.Runner.Wait(dump)
+
+	if err != nil {
+		return 0, fmt.Errorf("mysqldump --tab failed, check the FILE privilege and secure_file_priv of the source: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return 0, err
+	}
+
+	tables := []string{}
+	others := []string{}
+
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), ".sql")
+
+		if !found {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, name+".txt")); err == nil {
+			tables = append(tables, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+
+	var bytes int64
+
+	/* Create the tables before the views that may read them */
+	for _, name := range append(slices.Clone(tables), others...) {
+		size, err := r.ImportSqlFile(opts, target, targetDB, filepath.Join(dir, name+".sql"))
+		bytes += size
+
+		if err != nil {
+			return bytes, err
+		}
+	}
+
+	size, err := LoadDataFiles(opts, source, target, targetDB, dir, tables)
+	bytes += size
+
+	return bytes, err
+}
+
+/* Imports a sql file into the target database with the mysql client */
+func (r *Replicator) ImportSqlFile(opts Options, target Connection, targetDB string, path string) (int64, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	return r.ImportSql(opts, target, targetDB, file)
+}
+
+/* Imports a sql stream into the target database and returns its size */
+func (r *Replicator) ImportSql(opts Options, target Connection, targetDB string, reader io.Reader) (int64, error) {
+	counter := &CountingWriter{Writer: io.Discard}
+	input := io.Reader(io.TeeReader(reader, counter))
+
+	if opts.Rewrite_definer != nil {
+		input = NewDefinerRewriter(input, *opts.Rewrite_definer)
+	}
+
+	mysql := GetMysqlCommand(target, targetDB)
+	mysql.Stdin = r.ImportInput(opts, input)
+	mysql.Stdout = r.ImportOutput()
+	mysql.Stderr = mysql.Stdout
+
+	err := r.Runner.Start(mysql)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.Runner.Wait(mysql)
+
+	return counter.Count, err
+}
+
+/* Loads the .txt data file of every table with LOAD DATA LOCAL INFILE, using --threads connections */
+func LoadDataFiles(opts Options, source Connection, target Connection, targetDB string, dir string, tables []string) (int64, error) {
+	dsn, err := GetDSN(target)
+
+	if err != nil {
+		return 0, err
+	}
+
+	/* Tables are loaded in any order, so foreign keys can't be checked meanwhile */
+	params := "?allowAllFiles=true&foreign_key_checks=0&unique_checks=0"
+
+	if opts.Import_sql_mode != nil {
+		params += "&sql_mode=" + url.QueryEscape(fmt.Sprintf("'%s'", strings.ReplaceAll(*opts.Import_sql_mode, "'", "''")))
+	}
+
+	sql, err := sql.Open("mysql", dsn+targetDB+params)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer sql.Close()
+
+	threads := opts.Threads
+
+	if threads == 0 {
+		threads = 4
+	}
+
+	sql.SetMaxOpenConns(threads)
+
+	modifier := ""
+
+	if opts.Insert_ignore {
+		modifier = "IGNORE "
+	} else if opts.Replace {
+		modifier = "REPLACE "
+	}
+
+	/* The data files are written in the character set of the dump */
+	charset := GetDumpCharset(opts, source)
+
+	/* Library callers skip the checks of the command line and the config file */
+	if !CHARSET_REGEXP.MatchString(charset) {
+		return 0, ConfigErrorf("invalid character set '%s', only letters, digits and '_' are allowed", charset)
+	}
+
+	queue := make(chan string)
+	errs := make(chan error, len(tables))
+
+	var bytes int64
+	var mutex sync.Mutex
+	var group sync.WaitGroup
+
+	for range threads {
+		group.Add(1)
+
+		go func() {
+			defer group.Done()
+
+			for table := range queue {
+				path := filepath.Join(dir, table+".txt")
+
+				_, err := sql.Exec(fmt.Sprintf("LOAD DATA LOCAL INFILE %s %sINTO TABLE %s CHARACTER SET %s", QuoteValue([]byte(path), "VARCHAR"), modifier, QuoteIdentifier(table), charset))
+
+				if err != nil {
+					errs <- fmt.Errorf("loading %s: %w", table, err)
+					continue
+				}
+
+				if info, err := os.Stat(path); err == nil {
+					mutex.Lock()
+					bytes += info.Size()
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, table := range tables {
+		queue <- table
+	}
+
+	close(queue)
+	group.Wait()
+	close(errs)
+
+	return bytes, <-errs
+}
+
+func (r *Replicator) ReplicateTablesWithoutData(opts Options, source Connection, target Connection, sourceDB string, targetDB string) (int64, error) {
+	/* Without schema-only tables the dump command would select the whole database */
+	if len(GetSchemaPassTables(opts)) == 0 {
+		return 0, nil
+	}
+
+	c1 := GetDumpCommand(opts, source, sourceDB, false, nil)
+	c2 := GetMysqlCommand(target, targetDB)
+
+	bytes, err := r.PipeCommands(opts, GetPipeline(opts, c1, c2)...)
+
+	if err != nil {
+		return bytes, err
+	}
+
+	return bytes, nil
+}
+
+/* Dumps the views in a final pass so the tables they depend on already exist */
+func (r *Replicator) ReplicateViews(opts Options, source Connection, target Connection, sourceDB string, targetDB string) (int64, error) {
+	views, err := GetViews(source, sourceDB)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(views) == 0 {
+		return 0, nil
+	}
+
+	c1 := GetViewsDumpCommand(opts, source, sourceDB, views)
+	c2 := GetMysqlCommand(target, targetDB)
+
+	return r.PipeCommands(opts, GetPipeline(opts, c1, c2)...)
+}
+
+/* Dumps only the stored procedures and functions, each preceded by a DROP ... IF EXISTS */
+func GetRoutinesDumpCommand(connection Connection, dbName string) *exec.Cmd {
+	args := GetCredentialArgs(connection)
+
+	args = append(args,
+		fmt.Sprintf("--host=%s", GetCommandHost(connection)),
+		fmt.Sprintf("--port=%d", GetPort(connection)),
+		"--skip-lock-tables",
+		"--single-transaction",
+		"--set-gtid-purged=OFF",
+		fmt.Sprintf("--default-character-set=%s", GetCharset(connection)),
+		"--routines",
+		"--no-create-info",
+		"--no-data",
+		"--no-create-db",
+		"--skip-triggers",
+		"--no-tablespaces",
+		dbName,
+	)
+
+	return GetSourceCommand(connection, "mysqldump", args)
+}
+
+/* Replaces the routines of the target database with the ones of the source, leaving tables and data alone */
+func (r *Replicator) RunCopyRoutines(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return err
+	}
+
+	if target.Read_only {
+		return ConfigErrorf("server '%s' is read-only and can't be used as target", target.Name)
+	}
+
+	if IsSameServer(source, target) {
+		return ConfigErrorf("refusing to copy the routines of %s:%s onto themselves", source.Name, opts.Db)
+	}
+
+	PRINTER.Printf("  %s:%s ━━━▶ %s:%s\n", source.Name, opts.Db, target.Name, opts.Db)
+
+	start := time.Now()
+
+	PRINTER.Progress("  ┗━ Replicating routines ...")
+	c1 := GetRoutinesDumpCommand(source, opts.Db)
+	c2 := GetMysqlCommand(target, opts.Db)
+	bytes, err := r.PipeCommands(opts, c1, c2)
+	if err != nil {
+		PRINTER.Result("  ┗━ Replicating routines ... ✖\n")
+		return err
+	}
+	PRINTER.Result("  ┣━ Replicating routines ... ✔")
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("  ┗━ Done in %sm. %s transferred\n\n", diff, FormatBytes(bytes))
+
+	return nil
+}
+
+func QuoteIdentifier(name string) string {
+	return fmt.Sprintf("`%s`", strings.ReplaceAll(name, "`", "``"))
+}
+
+/* Formats a raw column value as a SQL literal according to its column type */
+func QuoteValue(value sql.RawBytes, typeName string) string {
+	if value == nil {
+		return "NULL"
+	}
+
+	switch strings.TrimPrefix(typeName, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE", "YEAR":
+		return string(value)
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY":
+		if len(value) == 0 {
+			return "''"
+		}
+
+		return fmt.Sprintf("0x%x", []byte(value))
+	}
+
+	replacer := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\x00", "\\0", "\n", "\\n", "\r", "\\r", "\x1a", "\\Z")
+
+	return fmt.Sprintf("'%s'", replacer.Replace(string(value)))
+}
+
+/* Runs query on the source and writes the resulting rows as INSERT statements into table */
+func WriteInsertStatements(w io.Writer, source *sql.DB, table string, query string) error {
+	rows, err := source.Query(query)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+
+	if err != nil {
+		return err
+	}
+
+	columns := lo.Map(columnTypes, func(column *sql.ColumnType, index int) string {
+		return QuoteIdentifier(column.Name())
+	})
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", QuoteIdentifier(table), strings.Join(columns, ", "))
+
+	values := make([]sql.RawBytes, len(columnTypes))
+	pointers := make([]any, len(columnTypes))
+
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	batch := []string{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		_, err := fmt.Fprintf(w, "%s%s;\n", insert, strings.Join(batch, ",\n"))
+		batch = batch[:0]
+
+		return err
+	}
+
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+
+		if err != nil {
+			return err
+		}
+
+		literals := make([]string, len(values))
+
+		for i, value := range values {
+			literals[i] = QuoteValue(value, columnTypes[i].DatabaseTypeName())
+		}
+
+		batch = append(batch, fmt.Sprintf("(%s)", strings.Join(literals, ", ")))
+
+		if len(batch) >= 1000 {
+			err = flush()
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+/* Copies the rows returned by query on the source into table on the target database */
+func (r *Replicator) ReplicateSelectedRows(opts Options, source Connection, target Connection, sourceDB string, targetDB string, table string, query string) (int64, error) {
+	sourceConnection, err := OpenDatabaseConnection(source, sourceDB)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer sourceConnection.Close()
+
+	pr, pw := io.Pipe()
+
+	counter := &CountingWriter{Writer: pw}
+
+	c := GetMysqlCommand(target, targetDB)
+	c.Stdin = r.ImportInput(opts, pr)
+	c.Stdout = r.ImportOutput()
+	c.Stderr = c.Stdout
+
+	err = r.Runner.Start(c)
+
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		/* The rows are read by the driver as utf8mb4, whatever the Charset of the target */
+		fmt.Fprintln(counter, "SET NAMES utf8mb4;")
+		fmt.Fprintln(counter, "SET FOREIGN_KEY_CHECKS=0;")
+
+		err := WriteInsertStatements(counter, sourceConnection, table, query)
+
+		if err == nil {
+			fmt.Fprintln(counter, "SET FOREIGN_KEY_CHECKS=1;")
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	err = r.Runner.Wait(c)
+
+	if err != nil {
+		return counter.Count, err
+	}
+
+	return counter.Count, nil
+}
+
+/*
+Lists the columns of a table in order, leaving out the excluded ones and the generated ones. The server
+computes generated columns (VIRTUAL or STORED) itself and rejects any value given for them on insert
+*/
+func GetSelectedColumns(connection Connection, dbName string, table string, excluded []string) ([]string, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	rows, err := sql.Query("SELECT COLUMN_NAME, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", dbName, table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	columns := []string{}
+
+	for rows.Next() {
+		var column, extra string
+
+		if err := rows.Scan(&column, &extra); err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(excluded, column) && !IsGeneratedColumn(extra) {
+			columns = append(columns, column)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns left to copy")
+	}
+
+	return columns, nil
+}
+
+/*
+Tells generated columns apart by the EXTRA of information_schema.COLUMNS, "VIRTUAL GENERATED" or "STORED GENERATED".
+DEFAULT_GENERATED only marks an expression default, e.g. DEFAULT CURRENT_TIMESTAMP, and the column is copied
+*/
+func IsGeneratedColumn(extra string) bool {
+	extra = strings.ToUpper(extra)
+
+	return strings.Contains(extra, "VIRTUAL GENERATED") || strings.Contains(extra, "STORED GENERATED")
+}
+
+/*
+Builds the SELECT reading the configured partitions and columns of a table. The columns are always
+listed, so generated columns are left out even when no column is excluded
+*/
+func GetSelectQuery(source Connection, sourceDB string, table string) (string, error) {
+	selected, err := GetSelectedColumns(source, sourceDB, table, CONFIG.Exclude_columns[table])
+
+	if err != nil {
+		return "", err
+	}
+
+	columns := strings.Join(lo.Map(selected, func(column string, index int) string {
+		return QuoteIdentifier(column)
+	}), ", ")
+
+	query := fmt.Sprintf("SELECT %s FROM %s", columns, QuoteIdentifier(table))
+
+	if partitions, found := CONFIG.Partitions[table]; found {
+		query += fmt.Sprintf(" PARTITION (%s)", strings.Join(lo.Map(partitions, func(partition string, index int) string {
+			return QuoteIdentifier(partition)
+		}), ", "))
+	}
+
+	return query, nil
+}
+
+/* Copies the configured partitions and columns of the tables left out of the data pass */
+func (r *Replicator) ReplicateSelectedTables(opts Options, source Connection, target Connection, sourceDB string, targetDB string) (int64, error) {
+	var total int64
+
+	for _, table := range GetSelectedTables(opts) {
+		query, err := GetSelectQuery(source, sourceDB, table)
+
+		if err != nil {
+			return total, fmt.Errorf("table %s: %w", table, err)
+		}
+
+		bytes, err := r.ReplicateSelectedRows(opts, source, target, sourceDB, targetDB, table, query)
+		total += bytes
+
+		if err != nil {
+			return total, fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+
+	return total, nil
+}
+
+func CleanTargetDatabase(opts Options, connection Connection, target string) error {
+	sql, err := OpenDatabaseConnection(connection, target)
+
+	if err != nil {
+		return err
+	}
+
+	defer sql.Close()
+
+	for _, query := range GetPostProcessQueries(opts) {
+		if query.Batch_size > 0 {
+			err = RunBatchedQuery(sql, query)
+		} else {
+			_, err = sql.Exec(query.Query)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Runs a DELETE in batches of Batch_size rows until a batch deletes fewer rows, keeping each lock short */
+func RunBatchedQuery(db *sql.DB, query PostProcessQuery) error {
+	statement, err := GetBatchedQuery(query)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		result, err := db.Exec(statement)
+
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+
+		if err != nil {
+			return err
+		}
+
+		if deleted < int64(query.Batch_size) {
+			return nil
+		}
+
+		time.Sleep(BATCH_PAUSE)
+	}
+}
+
+/* Allowlist of the tables copied with data: --data-tables, or the Data_tables of the config unless -i */
+func GetDataTables(opts Options) []string {
+	if len(opts.Data_tables) > 0 {
+		return opts.Data_tables
+	}
+
+	if opts.Use_empty_tables {
+		return CONFIG.Data_tables
+	}
+
+	return []string{}
+}
+
+/* Tables of a database left out of the data allowlist, whose data is left out like Empty_tables */
+func GetNonDataTables(opts Options, tables []string) []string {
+	if len(GetDataTables(opts)) == 0 {
+		return []string{}
+	}
+
+	return lo.Without(tables, GetDataTables(opts)...)
+}
+
+/* Tables above --max-table-size, biggest first, whose data is left out like Empty_tables */
+func GetLargeTables(opts Options, tables []TableSize) []TableSize {
+	if opts.Max_table_size <= 0 {
+		return []TableSize{}
+	}
+
+	return lo.Filter(tables, func(table TableSize, index int) bool {
+		return table.Size > opts.Max_table_size
+	})
+}
+
+/*
+Checks every post-process query without changing any data. DML statements are EXPLAINed, which
+also resolves tables and columns; anything else is only parsed as a prepared statement
+*/
+func ValidatePostProcessQueries(opts Options, connection Connection, target string) ([]error, error) {
+	sql, err := OpenDatabaseConnection(connection, target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer sql.Close()
+
+	/* PREPARE is session state, so everything must run on the same connection */
+	sql.SetMaxOpenConns(1)
+
+	invalid := []error{}
+
+	for _, entry := range GetPostProcessQueries(opts) {
+		query := entry.Query
+
+		if entry.Batch_size > 0 {
+			query, err = GetBatchedQuery(entry)
+
+			if err != nil {
+				invalid = append(invalid, err)
+				continue
+			}
+		}
+
+		fields := strings.Fields(query)
+		verb := ""
+
+		if len(fields) > 0 {
+			verb = strings.ToUpper(fields[0])
+		}
+
+		if slices.Contains([]string{"SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE"}, verb) {
+			_, err = sql.Exec("EXPLAIN " + query)
+		} else {
+			_, err = sql.Exec("PREPARE dump_validate FROM ?", query)
+
+			if err == nil {
+				_, err = sql.Exec("DEALLOCATE PREPARE dump_validate")
+			}
+		}
+
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("%s: %w", query, err))
+		}
+	}
+
+	return invalid, nil
+}
+
+/* Rows a post-process query would affect, as reported by --post-dry-run */
+type PostPreview struct {
+	Query   string
+	Rows    int64
+	Counted bool
+	Where   bool
+}
+
+/*
+Counts the rows each DELETE and UPDATE post-process query would affect, without running them. The
+other queries can't be counted and are only listed
+*/
+func PreviewPostProcessQueries(opts Options, connection Connection, target string) ([]PostPreview, error) {
+	sql, err := OpenDatabaseConnection(connection, target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer sql.Close()
+
+	previews := []PostPreview{}
+
+	for _, entry := range GetPostProcessQueries(opts) {
+		preview := PostPreview{Query: entry.Query}
+
+		count, ok := GetPreviewQuery(entry.Query)
+
+		if ok {
+			err = sql.QueryRow(count).Scan(&preview.Rows)
+
+			if err != nil {
+				return previews, fmt.Errorf("%s: %w", entry.Query, err)
+			}
+
+			preview.Counted = true
+			preview.Where = FindKeyword(count, "WHERE") != -1
+		}
+
+		previews = append(previews, preview)
+	}
+
+	return previews, nil
+}
+
+/*
+Rewrites a DELETE or UPDATE into a SELECT COUNT(*) of the rows it matches, keeping its tables and
+WHERE but not its ORDER BY or LIMIT. Multi-table DELETEs and other statements return false
+*/
+func GetPreviewQuery(query string) (string, bool) {
+	statement := strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	fields := strings.Fields(statement)
+
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	/* ORDER BY and LIMIT only cap the affected rows, and would cap the count instead */
+	cut := func(clause string) string {
+		for _, keyword := range []string{"ORDER", "LIMIT"} {
+			if index := FindKeyword(clause, keyword); index != -1 {
+				clause = clause[:index]
+			}
+		}
+
+		return strings.TrimSpace(clause)
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "DELETE":
+		from := FindKeyword(statement, "FROM")
+
+		if from == -1 || FindKeyword(statement, "USING") != -1 {
+			return "", false
+		}
+
+		/* Only modifiers may come before FROM, otherwise it's a multi-table DELETE */
+		for _, word := range strings.Fields(statement[len(fields[0]):from]) {
+			if !slices.Contains([]string{"LOW_PRIORITY", "QUICK", "IGNORE"}, strings.ToUpper(word)) {
+				return "", false
+			}
+		}
+
+		return "SELECT COUNT(*) " + cut(statement[from:]), true
+	case "UPDATE":
+		set := FindKeyword(statement, "SET")
+
+		if set == -1 {
+			return "", false
+		}
+
+		tables := strings.Fields(statement[len(fields[0]):set])
+
+		for len(tables) > 0 && slices.Contains([]string{"LOW_PRIORITY", "IGNORE"}, strings.ToUpper(tables[0])) {
+			tables = tables[1:]
+		}
+
+		count := "SELECT COUNT(*) FROM " + strings.Join(tables, " ")
+
+		if where := FindKeyword(statement[set:], "WHERE"); where != -1 {
+			count += " " + cut(statement[set+where:])
+		}
+
+		return count, true
+	}
+
+	return "", false
+}
+
+/* Returns the index of the first keyword of a statement outside quotes and parentheses, or -1 */
+func FindKeyword(statement string, keyword string) int {
+	var quote byte
+	depth := 0
+
+	isWord := func(c byte) bool {
+		return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (i == 0 || !isWord(statement[i-1])) && strings.HasPrefix(strings.ToUpper(statement[i:]), keyword):
+			end := i + len(keyword)
+
+			if end == len(statement) || !isWord(statement[end]) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+/*
+Returns the schema-only tables of the config that don't exist in the source database. Naming them
+in the schema-only pass would make mysqldump fail and abort the copy
+*/
+func GetMissingSchemaOnlyTables(opts Options, source Connection, dbName string) ([]string, error) {
+	tables, err := GetTableSizes(source, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	views, err := GetViews(source, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := append(lo.Map(tables, func(table TableSize, index int) string { return table.Name }), views...)
+
+	return lo.Filter(GetSchemaOnlyTables(opts), func(table string, index int) bool {
+		return !slices.Contains(names, table)
+	}), nil
+}
+
+/* Counts tables and approximate rows of a database using information_schema */
+func GetDatabaseStats(connection Connection, dbName string) (int64, int64, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer CloseConnection(sql)
+
+	var tables, rows int64
+
+	err = sql.QueryRow("SELECT COUNT(*), COALESCE(SUM(TABLE_ROWS), 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?", dbName).Scan(&tables, &rows)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return tables, rows, nil
+}
+
+/* Reads the schema version of a database. Returns false when the database or the version table doesn't exist */
+func GetSchemaVersion(connection Connection, dbName string) (string, bool, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	defer CloseConnection(sql)
+
+	var count int
+
+	err = sql.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", dbName, CONFIG.Schema_version_table.Table).Scan(&count)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if count == 0 {
+		return "", false, nil
+	}
+
+	var version string
+
+	query := fmt.Sprintf("SELECT COALESCE(MAX(%s), '') FROM %s.%s", QuoteIdentifier(CONFIG.Schema_version_table.Column), QuoteIdentifier(dbName), QuoteIdentifier(CONFIG.Schema_version_table.Table))
+
+	err = sql.QueryRow(query).Scan(&version)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return version, true, nil
+}
+
+/* Aborts when the target already has a schema version different from the source */
+func CheckSchemaVersion(opts Options, source Connection, target Connection, sourceDB string, targetDB string) error {
+	if opts.Force || CONFIG.Schema_version_table.Table == "" || CONFIG.Schema_version_table.Column == "" {
+		return nil
+	}
+
+	targetVersion, found, err := GetSchemaVersion(target, targetDB)
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return nil
+	}
+
+	sourceVersion, found, err := GetSchemaVersion(source, sourceDB)
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		sourceVersion = "none"
+	}
+
+	if sourceVersion != targetVersion {
+		return ConfigErrorf("schema version mismatch: source %s:%s is '%s', target %s:%s is '%s'. Use --force to overwrite", source.Name, sourceDB, sourceVersion, target.Name, targetDB, targetVersion)
+	}
+
+	return nil
+}
+
+/*
+Runs ReplicateDatabase again, up to --retry-db times, when it fails with a transient error. An
+attempt resumes from the table in progress when the failed one saved its progress and the copy can
+resume, otherwise it starts over, dropping and recreating the target
+*/
+func (r *Replicator) ReplicateDatabaseWithRetry(opts Options, source Connection, target Connection, sourceDB string, targetDB string) (ReplicationStats, error) {
+	for attempt := 1; ; attempt++ {
+		stats, err := r.ReplicateDatabase(opts, source, target, sourceDB, targetDB)
+
+		if err == nil || attempt > opts.Retry_db || !IsRetryableError(err) {
+			return stats, err
+		}
+
+		PRINTER.Printf("  Retrying %s (%d of %d) after: %s\n", sourceDB, attempt, opts.Retry_db, err)
+
+		/* The target existing now is the partial copy of the failed attempt */
+		if opts.On_exists == "fail" {
+			opts.On_exists = "drop"
+		}
+
+		/* Resume from the table in progress instead of starting the database over */
+		if state, err := LoadCopyState(GetStatePath(opts, target, targetDB)); err == nil && state.Current != "" && CanResume(opts) && r.Archive == nil {
+			opts.Resume_from = state.Current
+		}
+
+		/* The --also-zip file starts over with the new attempt */
+		if r.Archive != nil {
+			err = r.Archive.Truncate(0)
+
+			if err == nil {
+				_, err = r.Archive.Seek(0, io.SeekStart)
+			}
+
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		time.Sleep(time.Duration(attempt) * 5 * time.Second)
+	}
+}
+
+var RETRYABLE_ERRORS = []string{
+	"lost connection to mysql server",
+	"mysql server has gone away",
+	"broken pipe",
+	"connection reset",
+	"timed out",
+	"i/o timeout",
+	"invalid connection",
+}
+
+/* Reports whether an error is a network hiccup worth retrying, unlike auth or unknown database errors */
+func IsRetryableError(err error) bool {
+	var replicationErr ReplicationError
+
+	/* Import warnings and config errors would happen again */
+	if errors.As(err, &ConfigError{}) || (errors.As(err, &replicationErr) && replicationErr.Step == STEP_WARNINGS) {
+		return false
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+
+	return slices.ContainsFunc(RETRYABLE_ERRORS, func(pattern string) bool {
+		return strings.Contains(message, pattern)
+	})
+}
+
+func (r *Replicator) ReplicateDatabase(opts Options, source Connection, target Connection, sourceDB string, targetDB string) (ReplicationStats, error) {
+	stats := ReplicationStats{}
+
+	fail := func(step ReplicationStep, err error) error {
+		return ReplicationError{Step: step, DB: sourceDB, Source: source.Name, Target: target.Name, Err: err}
+	}
+
+	/* Creating the target would drop the database being dumped */
+	if IsSameServer(source, target) && sourceDB == targetDB {
+		return stats, fail(STEP_CHECK, ConfigErrorf("refusing to copy %s:%s onto itself", source.Name, sourceDB))
+	}
+
+	if opts.Dumper == "mysqlpump" && sourceDB != targetDB {
+		return stats, fail(STEP_CHECK, ConfigErrorf("mysqlpump qualifies tables with the database name and can't rename %s to %s", sourceDB, targetDB))
+	}
+
+	PRINTER.Printf("  %s:%s ━━━▶ %s:%s\n", source.Name, sourceDB, target.Name, targetDB)
+
+	start := time.Now()
+
+	WarnInconsistentLockMode(opts, source, sourceDB)
+
+	r.Warnings = &ImportWarnings{Out: os.Stdout}
+	defer func() { r.Warnings = nil }()
+
+	if opts.Check_import {
+		r.Imports = &ImportCounter{}
+		defer func() { r.Imports = nil }()
+	}
+
+	statePath := GetStatePath(opts, target, targetDB)
+
+	/* Progress saved by an earlier copy only applies when resuming it */
+	if opts.Resume_from == "" {
+		os.Remove(statePath)
+	}
+
+	/* Protect targets holding a different schema version */
+	PRINTER.Progress("  ┗━ Checking schema version ...")
+	err := CheckSchemaVersion(opts, source, target, sourceDB, targetDB)
+	if err != nil {
+		PRINTER.Result("  ┗━ Checking schema version ... ✖\n")
+		return stats, fail(STEP_CHECK, err)
+	}
+	PRINTER.Result("  ┣━ Checking schema version ... ✔")
+
+	/* A source behind Ssh_host can't be queried from here */
+	if len(GetSchemaOnlyTables(opts)) > 0 && source.Ssh_host == "" {
+		PRINTER.Progress("  ┗━ Checking empty tables ...")
+		missing, err := GetMissingSchemaOnlyTables(opts, source, sourceDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking empty tables ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		if len(missing) > 0 && opts.Strict {
+			PRINTER.Result("  ┗━ Checking empty tables ... ✖\n")
+			return stats, fail(STEP_CHECK, ConfigErrorf("tables of Empty_tables, Partitions or Exclude_columns not found in %s: %s", sourceDB, strings.Join(missing, ", ")))
+		}
+		PRINTER.Result("  ┣━ Checking empty tables ... ✔")
+		if len(missing) > 0 {
+			PRINTER.Printf("  ┣━ Warning: skipping config tables not found in the source: %s\n", strings.Join(missing, ", "))
+		}
+		opts.Missing_tables = missing
+	}
+
+	if opts.Max_table_size > 0 {
+		if source.Ssh_host != "" {
+			return stats, fail(STEP_CHECK, ConfigErrorf("--max-table-size can't be used with a source behind Ssh_host"))
+		}
+
+		PRINTER.Progress("  ┗━ Checking table sizes ...")
+		sizes, err := GetTableSizes(source, sourceDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking table sizes ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		large := GetLargeTables(opts, sizes)
+		PRINTER.Result(fmt.Sprintf("  ┣━ Checking table sizes ... ✔ %d tables over %s", len(large), FormatBytes(opts.Max_table_size)))
+		if len(large) > 0 {
+			PRINTER.Printf("  ┣━ Schema only: %s\n", strings.Join(lo.Map(large, func(table TableSize, index int) string {
+				return fmt.Sprintf("%s (%s)", table.Name, FormatBytes(table.Size))
+			}), ", "))
+		}
+		opts.Large_tables = lo.Map(large, func(table TableSize, index int) string { return table.Name })
+	}
+
+	if len(GetDataTables(opts)) > 0 {
+		if source.Ssh_host != "" {
+			return stats, fail(STEP_CHECK, ConfigErrorf("Data_tables and --data-tables can't be used with a source behind Ssh_host"))
+		}
+
+		/* Every table out of the allowlist only gets its schema */
+		PRINTER.Progress("  ┗━ Checking data tables ...")
+		sizes, err := GetTableSizes(source, sourceDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking data tables ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		names := lo.Map(sizes, func(table TableSize, index int) string { return table.Name })
+		opts.Non_data_tables = GetNonDataTables(opts, names)
+		PRINTER.Result(fmt.Sprintf("  ┣━ Checking data tables ... ✔ %d of %d tables with data", len(names)-len(opts.Non_data_tables), len(names)))
+		if missing := lo.Without(GetDataTables(opts), names...); len(missing) > 0 {
+			PRINTER.Printf("  ┣━ Warning: data tables not found in the source: %s\n", strings.Join(missing, ", "))
+		}
+	}
+
+	/* Writes to the source wait from here until its last read, after the selected rows */
+	var lock *ReadLock
+
+	if opts.Consistent {
+		if source.Ssh_host != "" || IsSameServer(source, target) {
+			return stats, fail(STEP_CHECK, ConfigErrorf("--consistent can't be used with a source behind Ssh_host or with the same server as target"))
+		}
+
+		PRINTER.Progress("  ┗━ Locking source for writes ...")
+		lock, err = AcquireReadLock(source)
+		if err != nil {
+			PRINTER.Result("  ┗━ Locking source for writes ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		PRINTER.Result("  ┣━ Locking source for writes ... ✔")
+
+		defer lock.Release()
+	}
+
+	/* Read from the source now, so the results match the dumped data */
+	if opts.Use_empty_tables && len(CONFIG.Pre_process_queries) > 0 {
+		if source.Ssh_host != "" {
+			return stats, fail(STEP_CHECK, ConfigErrorf("Pre_process_queries can't be used with a source behind Ssh_host"))
+		}
+
+		PRINTER.Progress("  ┗━ Running pre-process queries ...")
+		opts.Pre_results, err = RunPreProcessQueries(source, sourceDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Running pre-process queries ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		PRINTER.Result("  ┣━ Running pre-process queries ... ✔")
+	}
+
+	/* Tables with the same checksum on both sides are kept as they are */
+	unchanged := []string{}
+
+	if opts.Only_changed {
+		PRINTER.Progress("  ┗━ Comparing checksums ...")
+		unchanged, err = GetUnchangedTables(opts, source, target, sourceDB, targetDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Comparing checksums ... ✖\n")
+			return stats, fail(STEP_CHECK, err)
+		}
+		PRINTER.Result(fmt.Sprintf("  ┣━ Comparing checksums ... ✔ %d unchanged tables skipped", len(unchanged)))
+	}
+
+	if opts.Merge {
+		unmerged, err := GetUnmergedTables(opts, source, sourceDB)
+		if err != nil {
+			return stats, fail(STEP_CHECK, err)
+		}
+		unchanged = append(unchanged, unmerged...)
+	}
+
+	resumed := []string{}
+
+	if opts.Resume_from != "" {
+		resumed, err = GetResumedTables(opts, source, target, sourceDB, targetDB)
+		if err != nil {
+			return stats, fail(STEP_CHECK, err)
+		}
+		unchanged = append(unchanged, resumed...)
+		PRINTER.Printf("  ┣━ Resuming from %s, %d tables already copied\n", opts.Resume_from, len(resumed))
+	}
+
+	/* Replicate source database onto target database, ignoring some tables */
+	PRINTER.Progress("  ┗━ Creating target database ...")
+	err = CreateTargetDatabase(opts, target, targetDB)
+	if err != nil {
+		PRINTER.Result("  ┗━ Creating target database ... ✖\n")
+		return stats, fail(STEP_CREATE, err)
+	}
+	PRINTER.Result("  ┣━ Creating target database ... ✔")
+
+	/* Replicate source database onto target database, ignoring some tables */
+	PRINTER.Progress("  ┗━ Replicating tables with data ...")
+	var bytes int64
+	var position string
+	if opts.Fast_load {
+		bytes, err = r.FastLoadTablesWithData(opts, source, target, sourceDB, targetDB, unchanged)
+	} else {
+		if UsesCheckpoints(opts) {
+			r.Checkpoints = &TableCheckpoints{Path: statePath, State: CopyState{Source: source.Name, Database: sourceDB, Target: target.Name, Completed: resumed}}
+			r.Warnings.Checkpoint = r.Checkpoints.Complete
+		}
+		bytes, position, err = r.ReplicateTablesWithData(opts, source, target, sourceDB, targetDB, unchanged)
+		r.Checkpoints = nil
+		r.Warnings.Checkpoint = nil
+	}
+	stats.Bytes += bytes
+	if err != nil {
+		PRINTER.Result("  ┗━ Replicating tables with data ... ✖\n")
+		if state, loadErr := LoadCopyState(statePath); loadErr == nil && state.Current != "" {
+			PRINTER.Printf("  Resume with --resume-from %s\n", state.Current)
+		}
+		return stats, fail(STEP_DATA, err)
+	}
+	PRINTER.Result("  ┣━ Replicating tables with data ... ✔")
+
+	if position != "" {
+		PRINTER.Printf("  ┣━ Binlog position: %s\n", position)
+	}
+
+	/* Replicate schema for the ignored tables on the previous step */
+	PRINTER.Progress("  ┗━ Replicating tables without data ...")
+	bytes, err = r.ReplicateTablesWithoutData(opts, source, target, sourceDB, targetDB)
+	stats.Bytes += bytes
+	if err != nil {
+		PRINTER.Result("  ┗━ Replicating tables without data ... ✖\n")
+		return stats, fail(STEP_SCHEMA, err)
+	}
+	PRINTER.Result("  ┣━ Replicating tables without data ... ✔")
+
+	if opts.Truncate_empty && len(GetSkippedSchemaTables(opts)) > 0 {
+		PRINTER.Progress("  ┗━ Truncating empty tables ...")
+		err = TruncateEmptyTables(opts, target, targetDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Truncating empty tables ... ✖\n")
+			return stats, fail(STEP_TRUNCATE, err)
+		}
+		PRINTER.Result("  ┣━ Truncating empty tables ... ✔")
+	}
+
+	if opts.Views_last && !opts.No_views && !opts.Merge {
+		/* Create views once all the tables exist */
+		PRINTER.Progress("  ┗━ Replicating views ...")
+		bytes, err = r.ReplicateViews(opts, source, target, sourceDB, targetDB)
+		stats.Bytes += bytes
+		if err != nil {
+			PRINTER.Result("  ┗━ Replicating views ... ✖\n")
+			return stats, fail(STEP_VIEWS, err)
+		}
+		PRINTER.Result("  ┣━ Replicating views ... ✔")
+	}
+
+	if len(GetSelectedTables(opts)) > 0 {
+		/* Copy the selected partitions and columns of the tables skipped on the data pass */
+		PRINTER.Progress("  ┗━ Replicating selected rows ...")
+		bytes, err = r.ReplicateSelectedTables(opts, source, target, sourceDB, targetDB)
+		stats.Bytes += bytes
+		if err != nil {
+			PRINTER.Result("  ┗━ Replicating selected rows ... ✖\n")
+			return stats, fail(STEP_ROWS, err)
+		}
+		PRINTER.Result("  ┣━ Replicating selected rows ... ✔")
+	}
+
+	if lock != nil {
+		PRINTER.Printf("  ┣━ Source unlocked, writes were blocked for %s\n", lock.Release().Round(time.Second))
+	}
+
+	if r.Imports != nil {
+		/* Before the post-process queries, which may empty tables on purpose */
+		PRINTER.Progress("  ┗━ Checking import ...")
+		suspect, err := CheckImportedTables(target, targetDB, r.Imports)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking import ... ✖\n")
+			return stats, fail(STEP_IMPORT, err)
+		}
+		if len(suspect) > 0 && opts.Strict {
+			PRINTER.Result("  ┗━ Checking import ... ✖\n")
+			return stats, fail(STEP_IMPORT, fmt.Errorf("import of %s looks partial: %s", targetDB, strings.Join(suspect, ", ")))
+		}
+		PRINTER.Result(fmt.Sprintf("  ┣━ Checking import ... ✔ %d statements, %d tables created, %d filled", r.Imports.Statements, len(r.Imports.Created), len(r.Imports.Filled)))
+		if len(suspect) > 0 {
+			PRINTER.Printf("  ┣━ Warning: the import looks partial: %s\n", strings.Join(suspect, ", "))
+		}
+	}
+
+	if opts.Use_empty_tables && opts.Post_dry_run {
+		/* Count the rows the post-process queries would affect without running them */
+		PRINTER.Progress("  ┗━ Previewing post-process queries ...")
+		previews, err := PreviewPostProcessQueries(opts, target, targetDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Previewing post-process queries ... ✖\n")
+			return stats, fail(STEP_CLEANUP, err)
+		}
+		PRINTER.Result("  ┣━ Previewing post-process queries ... ✔")
+		for _, preview := range previews {
+			if !preview.Counted {
+				PRINTER.Printf("  ┃    would execute: %s\n", preview.Query)
+			} else if !preview.Where {
+				PRINTER.Printf("  ┃    %d rows, every row (no WHERE): %s\n", preview.Rows, preview.Query)
+			} else {
+				PRINTER.Printf("  ┃    %d rows: %s\n", preview.Rows, preview.Query)
+			}
+		}
+	} else if opts.Use_empty_tables && opts.Validate_queries {
+		/* Check the post-process queries against the copied data without running them */
+		PRINTER.Progress("  ┗━ Validating post-process queries ...")
+		invalid, err := ValidatePostProcessQueries(opts, target, targetDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Validating post-process queries ... ✖\n")
+			return stats, fail(STEP_CLEANUP, err)
+		}
+		if len(invalid) > 0 {
+			PRINTER.Result("  ┗━ Validating post-process queries ... ✖")
+			for _, err := range invalid {
+				PRINTER.Printf("     ✖ %s\n", err)
+			}
+			PRINTER.Printf("\n")
+			return stats, fail(STEP_CLEANUP, ConfigErrorf("%d of %d post-process queries are invalid", len(invalid), len(GetPostProcessQueries(opts))))
+		}
+		PRINTER.Result("  ┣━ Validating post-process queries ... ✔")
+	} else if opts.Use_empty_tables {
+		/* Clear user data */
+		PRINTER.Progress("  ┗━ Clear user data ...")
+		err = CleanTargetDatabase(opts, target, targetDB)
+		if err != nil {
+			PRINTER.Result("  ┗━ Clear user data ... ✖\n")
+			return stats, fail(STEP_CLEANUP, err)
+		}
+		PRINTER.Result("  ┣━ Clear user data ... ✔")
+	}
+
+	/* Collect table and row counts of the target database */
+	PRINTER.Progress("  ┗━ Collecting statistics ...")
+	stats.Tables, stats.Rows, err = GetDatabaseStats(target, targetDB)
+	if err != nil {
+		PRINTER.Result("  ┗━ Collecting statistics ... ✖\n")
+		return stats, fail(STEP_STATISTICS, err)
+	}
+	PRINTER.Result("  ┣━ Collecting statistics ... ✔")
+
+	/* Warnings of the import usually mean truncated or converted data */
+	stats.Warnings = r.Warnings.Count
+
+	if stats.Warnings > 0 {
+		PRINTER.Printf("  ┣━ %d import warnings, e.g.:\n", stats.Warnings)
+
+		for _, sample := range r.Warnings.Samples {
+			PRINTER.Printf("  ┃    %s\n", sample)
+		}
+
+		if opts.Strict {
+			PRINTER.Printf("  ┗━ Failed because of --strict\n\n")
+			return stats, fail(STEP_WARNINGS, fmt.Errorf("import of %s emitted %d warnings", targetDB, stats.Warnings))
+		}
+	}
+
+	os.Remove(statePath)
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("  ┗━ Done in %sm. %s transferred, %d tables, ~%d rows\n\n", diff, FormatBytes(stats.Bytes), stats.Tables, stats.Rows)
+
+	return stats, nil
+}
+
+/* Step of ReplicateDatabase where a ReplicationError happened */
+type ReplicationStep string
+
+const (
+	STEP_CHECK      ReplicationStep = "check"
+	STEP_CREATE     ReplicationStep = "create"
+	STEP_DATA       ReplicationStep = "data"
+	STEP_SCHEMA     ReplicationStep = "schema"
+	STEP_TRUNCATE   ReplicationStep = "truncate"
+	STEP_VIEWS      ReplicationStep = "views"
+	STEP_ROWS       ReplicationStep = "rows"
+	STEP_IMPORT     ReplicationStep = "import"
+	STEP_CLEANUP    ReplicationStep = "cleanup"
+	STEP_STATISTICS ReplicationStep = "statistics"
+	STEP_WARNINGS   ReplicationStep = "warnings"
+)
+
+/* Error of ReplicateDatabase, with the step that failed and the database being copied. Err is the cause */
+type ReplicationError struct {
+	Step   ReplicationStep
+	DB     string
+	Source string
+	Target string
+	Err    error
+}
+
+func (e ReplicationError) Error() string {
+	return fmt.Sprintf("%s step of %s failed: %s", e.Step, e.DB, e.Err)
+}
+
+func (e ReplicationError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Error caused by the config file, the options or the environment rather than by the servers during the run.
+Retrying doesn't help, so the CLI exits with a different code for it
+*/
+type ConfigError struct {
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func ConfigErrorf(format string, args ...any) error {
+	return ConfigError{Err: fmt.Errorf(format, args...)}
+}
+
+func FindServer(name string, role string) (Connection, error) {
+	index := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
+		return c.Name == name
+	})
+
+	if index == -1 {
+		return Connection{}, ConfigErrorf("%s '%s' not found in config file", role, name)
+	}
+
+	connection := CONFIG.Servers[index]
+
+	if connection.Password_command != "" {
+		password, err := RunPasswordCommand(connection.Password_command)
+
+		if err != nil {
+			return connection, fmt.Errorf("password command of server '%s' failed: %w", name, err)
+		}
+
+		connection.Password = password
+	}
+
+	return connection, nil
+}
+
+var PASSWORD_CACHE = map[string]string{}
+
+/* Guards PASSWORD_CACHE, so a command looked up by parallel zip-all jobs also runs only once */
+var PASSWORD_MUTEX sync.Mutex
+
+/* Runs a Password_command once per run and returns its trimmed output */
+func RunPasswordCommand(command string) (string, error) {
+	PASSWORD_MUTEX.Lock()
+	defer PASSWORD_MUTEX.Unlock()
+
+	if password, ok := PASSWORD_CACHE[command]; ok {
+		return password, nil
+	}
+
+	cmd := GetShellCommand(command)
+
+	/* Secret managers may need to prompt, e.g. to unlock a vault */
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+
+	if err != nil {
+		return "", err
+	}
+
+	password := strings.TrimSpace(string(output))
+
+	if password == "" {
+		return "", fmt.Errorf("empty output")
+	}
+
+	PASSWORD_CACHE[command] = password
+
+	return password, nil
+}
+
+var SYSTEM_DATABASES = []string{"information_schema", "performance_schema", "mysql", "sys"}
+
+/*
+Replaces the transactions whose source contains % with one transaction per matching database of
+the source server. Only % is a wildcard, _ matches itself. Their target must be omitted or "*",
+so it's derived from each database name. System databases are never matched unless --include-system
+*/
+func ExpandTransactions(opts Options, source Connection, transactions [][]string) ([][]string, error) {
+	expanded := [][]string{}
+
+	for _, transaction := range transactions {
+		if !strings.Contains(transaction[0], "%") {
+			expanded = append(expanded, transaction)
+			continue
+		}
+
+		if len(transaction) > 1 && transaction[1] != "*" {
+			return nil, ConfigErrorf("the target of pattern '%s' must be omitted or \"*\"", transaction[0])
+		}
+
+		databases, err := GetDatabasesLike(source, transaction[0])
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, database := range databases {
+			if !opts.Include_system && slices.Contains(SYSTEM_DATABASES, strings.ToLower(database)) {
+				continue
+			}
+
+			expanded = append(expanded, []string{database, "*"})
+		}
+	}
+
+	return expanded, nil
+}
+
+func GetDatabasesLike(connection Connection, pattern string) ([]string, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	/* Same as SHOW DATABASES LIKE, which can't be prepared on every server version */
+	rows, err := sql.Query("SELECT SCHEMA_NAME FROM information_schema.SCHEMATA WHERE SCHEMA_NAME LIKE ? ORDER BY SCHEMA_NAME", strings.ReplaceAll(pattern, "_", "\\_"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	databases := []string{}
+
+	for rows.Next() {
+		var database string
+
+		err = rows.Scan(&database)
+
+		if err != nil {
+			return nil, err
+		}
+
+		databases = append(databases, database)
+	}
+
+	return databases, rows.Err()
+}
+
+/*
+Checks that every source database of the transactions exists before anything is dropped. Missing
+databases fail the run with the complete list, or are skipped with a warning with --skip-missing
+*/
+func CheckSourceDatabases(opts Options, source Connection, transactions [][]string) ([][]string, error) {
+	databases, err := GetDatabasesLike(source, "%")
+
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+
+	existing := lo.Filter(transactions, func(transaction []string, index int) bool {
+		if slices.Contains(databases, transaction[0]) {
+			return true
+		}
+
+		missing = append(missing, transaction[0])
+		return false
+	})
+
+	if len(missing) == 0 {
+		return transactions, nil
+	}
+
+	if !opts.Skip_missing {
+		return nil, ConfigErrorf("databases not found on %s: %s (use --skip-missing to skip them)", source.Name, strings.Join(missing, ", "))
+	}
+
+	for _, database := range missing {
+		PRINTER.Printf("  Skipping %s (not found on %s)\n", database, source.Name)
+	}
+
+	return existing, nil
+}
+
+func IsExcludedDatabase(opts Options, dbName string) bool {
+	return lo.SomeBy(opts.Exclude_db, func(pattern string) bool {
+		matched, err := filepath.Match(pattern, dbName)
+
+		return err == nil && matched
+	})
+}
+
+/*
+Returns the target database of a bulk transaction. When the target is omitted or "*", it's
+derived from the source name with the Target_replace pairs, Target_prefix and Target_suffix
+*/
+func GetTransactionTarget(transaction []string) string {
+	if len(transaction) > 1 && transaction[1] != "*" {
+		return transaction[1]
+	}
+
+	name := transaction[0]
+
+	for _, pair := range CONFIG.Target_replace {
+		if len(pair) == 2 {
+			name = strings.ReplaceAll(name, pair[0], pair[1])
+		}
+	}
+
+	return CONFIG.Target_prefix + name + CONFIG.Target_suffix
+}
+
+func FilterExcludedTransactions(opts Options, transactions [][]string) [][]string {
+	return lo.Filter(transactions, func(transaction []string, index int) bool {
+		if IsExcludedDatabase(opts, transaction[0]) {
+			PRINTER.Printf("  Skipping %s (excluded)\n", transaction[0])
+			return false
+		}
+
+		return true
+	})
+}
+
+/* Keeps the transactions whose source or target is named by --only, failing when a name matches none */
+func FilterOnlyTransactions(opts Options, transactions [][]string) ([][]string, error) {
+	if len(opts.Only) == 0 {
+		return transactions, nil
+	}
+
+	unmatched := lo.Filter(opts.Only, func(name string, index int) bool {
+		return !slices.ContainsFunc(transactions, func(transaction []string) bool {
+			return transaction[0] == name || GetTransactionTarget(transaction) == name
+		})
+	})
+
+	if len(unmatched) > 0 {
+		return nil, ConfigErrorf("--only names that match no transaction: %s", strings.Join(unmatched, ", "))
+	}
+
+	return lo.Filter(transactions, func(transaction []string, index int) bool {
+		return slices.Contains(opts.Only, transaction[0]) || slices.Contains(opts.Only, GetTransactionTarget(transaction))
+	}), nil
+}
+
+type BulkSummary struct {
+	Label     string         `json:"label,omitempty"`
+	Databases int            `json:"databases"`
+	Total     int            `json:"total"`
+	Bytes     int64          `json:"bytes"`
+	Elapsed   float64        `json:"elapsed_seconds"`
+	Versions  *VersionReport `json:"versions,omitempty"`
+	Results   []CopySummary  `json:"results"`
+}
+
+func (r *Replicator) RunBulk(opts Options) (summary BulkSummary, err error) {
+	defer func() {
+		NotifyWebhook(opts, GetBulkWebhookPayload(opts, summary, err))
+	}()
+
+	/* A run without databases would look like a successful sync */
+	if len(CONFIG.Transactions) == 0 && !opts.Allow_empty {
+		return BulkSummary{}, ConfigErrorf("no Transactions in the config file, nothing to copy (use --allow-empty to accept it)")
+	}
+
+	/* Every database goes to the same two servers, so share their connections across the run */
+	POOL = NewConnectionPool()
+
+	defer func() {
+		POOL.Close()
+		POOL = nil
+	}()
+
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	if target.Read_only {
+		return BulkSummary{}, ConfigErrorf("server '%s' is read-only and can't be used as target", target.Name)
+	}
+
+	err = CheckTargetCollation(opts, target)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	versions := ReportVersions(opts, source, &target)
+	PrintVersions(source, &target, versions)
+
+	start := time.Now()
+
+	PRINTER.Printf("\nStart bulk dump%s\n", GetLabelNote(opts))
+
+	transactions, err := ExpandTransactions(opts, source, CONFIG.Transactions)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	transactions, err = FilterOnlyTransactions(opts, transactions)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	transactions = FilterExcludedTransactions(opts, transactions)
+
+	transactions, err = CheckSourceDatabases(opts, source, transactions)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	if len(transactions) == 0 && !opts.Allow_empty {
+		return BulkSummary{}, ConfigErrorf("none of the %d Transactions left a database to copy (use --allow-empty to accept it)", len(CONFIG.Transactions))
+	}
+
+	counter := 0
+	var totalBytes int64
+	results := []CopySummary{}
+
+	for _, transaction := range transactions {
+		/* Stop before a database that would likely not finish within the budget */
+		if opts.Max_runtime > 0 {
+			elapsed := time.Since(start)
+			expected := elapsed
+
+			if counter > 0 {
+				expected += elapsed / time.Duration(counter)
+			}
+
+			if expected > opts.Max_runtime {
+				PRINTER.Printf("Runtime budget of %s exceeded, %d of %d databases done\n", opts.Max_runtime, counter, len(transactions))
+				break
+			}
+		}
+
+		dbStart := time.Now()
+		stats, err := r.ReplicateDatabaseWithRetry(opts, source, target, transaction[0], GetTransactionTarget(transaction))
+		totalBytes += stats.Bytes
+
+		result := CopySummary{Database: transaction[0], Direction: "db", Success: err == nil, Elapsed: time.Since(dbStart).Seconds()}
+
+		if err != nil {
+			result.Error = err.Error()
+			result.Step = GetErrorStep(err)
+		}
+
+		results = append(results, result)
+
+		if err != nil {
+			PRINTER.Printf("%s\n", err)
+			break
+		}
+
+		counter++
+	}
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("%d databases done in %sm. %s transferred\n", counter, diff, FormatBytes(totalBytes))
+
+	return BulkSummary{Label: opts.Label, Databases: counter, Total: len(transactions), Bytes: totalBytes, Elapsed: time.Since(start).Seconds(), Versions: &versions, Results: results}, nil
+}
+
+/* Streams the dump of a database with its data into w, without any intermediate file */
+func (r *Replicator) DumpToWriter(opts Options, source Connection, dbName string, w io.Writer) error {
+	views, err := GetIgnoredViews(opts, source, dbName)
+
+	if err != nil {
+		return err
+	}
+
+	dump := GetDumpCommand(opts, source, dbName, true, views)
+	dump.Stdout = w
+
+	err = r.Runner.Start(dump)
+
+	if err != nil {
+		return err
+	}
+
+	return r.Runner.Wait(dump)
+}
+
+func (r *Replicator) CopyToZip(opts Options) error {
+	opts.Use_empty_tables = false
+
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	versions := ReportVersions(opts, source, nil)
+	PrintVersions(source, nil, versions)
+	r.Versions = &versions
+
+	return r.ZipDatabase(opts, source, PRINTER)
+}
+
+/* Dumps opts.Db into the archive opts.Zip_filename, writing its progress lines to printer */
+func (r *Replicator) ZipDatabase(opts Options, source Connection, printer *Printer) error {
+	WarnInconsistentLockMode(opts, source, opts.Db)
+
+	if !opts.Skip_space_check {
+		err := CheckDiskSpace(opts, source)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	printer.Progress(fmt.Sprintf("Zipping %s ...", opts.Db))
+
+	/* The sql file is staged in the temp dir, so the output folder only receives the archive */
+	zipFilePath := filepath.Join(opts.Tmp_dir, fmt.Sprintf("%s_%s.sql", opts.Db, FormatTimestamp(opts)))
+	file, err := os.Create(zipFilePath)
+
+	if err != nil {
+		printer.Result(fmt.Sprintf("Zipping %s ... ✖.", opts.Db))
+		return err
+	}
+
+	defer func() {
+		if !opts.Keep_sql {
+			os.Remove(zipFilePath)
+		}
+	}()
+
+	defer file.Close()
+
+	position := &BinlogPositionWriter{}
+
+	/* Dump database to sql file */
+	progress := NewTableProgress(opts, source, opts.Db, fmt.Sprintf("Zipping %s ...", opts.Db), nil)
+
+	var lock *ReadLock
+
+	if opts.Consistent {
+		if source.Ssh_host != "" {
+			printer.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+			return ConfigErrorf("--consistent can't be used with a source behind Ssh_host")
+		}
+
+		lock, err = AcquireReadLock(source)
+
+		if err != nil {
+			printer.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+			return err
+		}
+	}
+
+	err = r.DumpToWriter(opts, source, opts.Db, io.MultiWriter(file, position, progress))
+
+	blocked := lock.Release()
+
+	if err != nil {
+		printer.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+		return err
+	}
+
+	err = WriteArchive(opts, source, zipFilePath)
+
+	if err != nil {
+		printer.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+		return err
+	}
+
+	/* Old archives are only rotated out once the new one is known to be readable */
+	archivePath := filepath.Join(opts.Zip_output_folder, opts.Zip_filename)
+
+	if opts.Rotate > 0 {
+		err = VerifyArchive(opts, archivePath)
+
+		if err != nil {
+			printer.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+			return fmt.Errorf("archive %s is not readable: %w", archivePath, err)
+		}
+	}
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	printer.Result(fmt.Sprintf("Zipping %s ... ✔. Elapsed time: %sm", opts.Db, diff))
+
+	if lock != nil {
+		printer.Printf("Source unlocked, writes were blocked for %s\n", blocked.Round(time.Second))
+	}
+
+	if position.Position != "" {
+		printer.Printf("Binlog position: %s\n", position.Position)
+	}
+
+	if opts.Rotate > 0 {
+		removed, err := RotateArchives(opts, archivePath)
+
+		for _, path := range removed {
+			printer.Printf("Removed old archive %s\n", path)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	printer.Printf("\n")
+
+	return nil
+}
+
+/*
+Dumps opts.Db into the plain sql file opts.Sql_file, to be applied later with the mysql client,
+e.g. on a server that can't be reached from here. Unlike the zip target, the file holds what a
+copy would import: the empty tables only get their schema and the post-process queries are
+appended, so applying it gives the same database as a copy
+*/
+func (r *Replicator) CopyToFile(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	versions := ReportVersions(opts, source, nil)
+	PrintVersions(source, nil, versions)
+	r.Versions = &versions
+
+	path := GetSqlFilePath(opts)
+
+	PRINTER.Printf("  %s:%s ━━━▶ %s\n", source.Name, opts.Db, path)
+
+	start := time.Now()
+
+	WarnInconsistentLockMode(opts, source, opts.Db)
+
+	/* A source behind Ssh_host can't be queried from here */
+	if len(GetSchemaOnlyTables(opts)) > 0 && source.Ssh_host == "" {
+		PRINTER.Progress("  ┗━ Checking empty tables ...")
+		missing, err := GetMissingSchemaOnlyTables(opts, source, opts.Db)
+		if err != nil {
+			PRINTER.Result("  ┗━ Checking empty tables ... ✖\n")
+			return err
+		}
+		if len(missing) > 0 && opts.Strict {
+			PRINTER.Result("  ┗━ Checking empty tables ... ✖\n")
+			return ConfigErrorf("tables of Empty_tables, Partitions or Exclude_columns not found in %s: %s", opts.Db, strings.Join(missing, ", "))
+		}
+		PRINTER.Result("  ┣━ Checking empty tables ... ✔")
+		if len(missing) > 0 {
+			PRINTER.Printf("  ┣━ Warning: skipping config tables not found in the source: %s\n", strings.Join(missing, ", "))
+		}
+		opts.Missing_tables = missing
+	}
+
+	var lock *ReadLock
+
+	if opts.Consistent {
+		if source.Ssh_host != "" {
+			return ConfigErrorf("--consistent can't be used with a source behind Ssh_host")
+		}
+
+		PRINTER.Progress("  ┗━ Locking source for writes ...")
+		lock, err = AcquireReadLock(source)
+		if err != nil {
+			PRINTER.Result("  ┗━ Locking source for writes ... ✖\n")
+			return err
+		}
+		PRINTER.Result("  ┣━ Locking source for writes ... ✔")
+
+		defer lock.Release()
+	}
+
+	if opts.Use_empty_tables && len(CONFIG.Pre_process_queries) > 0 {
+		if source.Ssh_host != "" {
+			return ConfigErrorf("Pre_process_queries can't be used with a source behind Ssh_host")
+		}
+
+		PRINTER.Progress("  ┗━ Running pre-process queries ...")
+		opts.Pre_results, err = RunPreProcessQueries(source, opts.Db)
+		if err != nil {
+			PRINTER.Result("  ┗━ Running pre-process queries ... ✖\n")
+			return err
+		}
+		PRINTER.Result("  ┣━ Running pre-process queries ... ✔")
+	}
+
+	PRINTER.Progress("  ┗━ Writing sql file ...")
+	bytes, err := r.WriteSqlFile(opts, source, path)
+	if err != nil {
+		PRINTER.Result("  ┗━ Writing sql file ... ✖\n")
+		os.Remove(path)
+		return err
+	}
+	PRINTER.Result("  ┣━ Writing sql file ... ✔")
+
+	if lock != nil {
+		PRINTER.Printf("  ┣━ Source unlocked, writes were blocked for %s\n", lock.Release().Round(time.Second))
+	}
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("  ┗━ Done in %sm. %s written\n\n", diff, FormatBytes(bytes))
+
+	return nil
+}
+
+/* Returns the path of the file: target, relative paths being taken from the output folder */
+func GetSqlFilePath(opts Options) string {
+	if filepath.IsAbs(opts.Sql_file) {
+		return opts.Sql_file
+	}
+
+	return filepath.Join(opts.Zip_output_folder, opts.Sql_file)
+}
+
+/*
+Writes the passes of a copy one after the other into the file at path, wrapped with the import
+prelude and epilogue: the tables with data, the schema-only tables, the views of --views-last, the
+selected rows and the post-process queries. Returns the size of the file
+*/
+func (r *Replicator) WriteSqlFile(opts Options, source Connection, path string) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	counter := &CountingWriter{Writer: file}
+
+	dump := func(c *exec.Cmd) error {
+		c.Stdout = counter
+
+		err := r.Runner.Start(c)
+
+		if err != nil {
+			return err
+		}
+
+		return r.Runner.Wait(c)
+	}
+
+	io.WriteString(counter, GetImportPrelude(opts))
+
+	err = r.DumpToWriter(opts, source, opts.Db, counter)
+
+	if err != nil {
+		return counter.Count, err
+	}
+
+	if len(GetSchemaPassTables(opts)) > 0 {
+		err = dump(GetDumpCommand(opts, source, opts.Db, false, nil))
+
+		if err != nil {
+			return counter.Count, err
+		}
+	}
+
+	if opts.Views_last && !opts.No_views {
+		views, err := GetViews(source, opts.Db)
+
+		if err != nil {
+			return counter.Count, err
+		}
+
+		if len(views) > 0 {
+			err = dump(GetViewsDumpCommand(opts, source, opts.Db, views))
+
+			if err != nil {
+				return counter.Count, err
+			}
+		}
+	}
+
+	if len(GetSelectedTables(opts)) > 0 {
+		sourceConnection, err := OpenDatabaseConnection(source, opts.Db)
+
+		if err != nil {
+			return counter.Count, err
+		}
+
+		defer sourceConnection.Close()
+
+		/* The rows are read by the driver as utf8mb4, whatever the Charset of the target */
+		fmt.Fprintln(counter, "SET NAMES utf8mb4;")
+
+		for _, table := range GetSelectedTables(opts) {
+			query, err := GetSelectQuery(source, opts.Db, table)
+
+			if err == nil {
+				err = WriteInsertStatements(counter, sourceConnection, table, query)
+			}
+
+			if err != nil {
+				return counter.Count, fmt.Errorf("table %s: %w", table, err)
+			}
+		}
+	}
+
+	/* Batch_size only matters on a live server, the file runs each query once */
+	if opts.Use_empty_tables {
+		for _, query := range GetPostProcessQueries(opts) {
+			fmt.Fprintf(counter, "%s;\n", strings.TrimRight(strings.TrimSpace(query.Query), ";"))
+		}
+	}
+
+	io.WriteString(counter, GetImportEpilogue(opts))
+
+	return counter.Count, file.Close()
+}
+
+/* Archive of one database of a zip-all run, as listed in its manifest */
+type ZipManifestEntry struct {
+	Database string `json:"database"`
+	Zip      string `json:"zip,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Sha256   string `json:"sha256,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ZipAllSummary struct {
+	Label     string             `json:"label,omitempty"`
+	Databases int                `json:"databases"`
+	Total     int                `json:"total"`
+	Bytes     int64              `json:"bytes"`
+	Elapsed   float64            `json:"elapsed_seconds"`
+	Manifest  string             `json:"manifest"`
+	Results   []ZipManifestEntry `json:"results"`
+}
+
+/*
+Zips every database of the opts.Source server, except the system ones, into its own archive in the
+output folder, --jobs at a time. A failed database doesn't stop the others: it's listed with its
+error in the manifest written next to the archives
+*/
+func (r *Replicator) RunZipAll(opts Options) (ZipAllSummary, error) {
+	opts.Use_empty_tables = false
+
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return ZipAllSummary{}, err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return ZipAllSummary{}, err
+	}
+
+	versions := ReportVersions(opts, source, nil)
+	PrintVersions(source, nil, versions)
+
+	databases, err := GetDatabasesLike(source, "%")
+
+	if err != nil {
+		return ZipAllSummary{}, err
+	}
+
+	databases = lo.Filter(databases, func(database string, index int) bool {
+		return !slices.Contains(SYSTEM_DATABASES, strings.ToLower(database)) && !IsExcludedDatabase(opts, database)
+	})
+
+	err = os.MkdirAll(opts.Zip_output_folder, 0755)
+
+	if err != nil {
+		return ZipAllSummary{}, err
+	}
+
+	jobs := max(opts.Jobs, 1)
+	start := time.Now()
+
+	PRINTER.Printf("\nStart zipping %d databases of %s, %d at a time%s\n", len(databases), source.Name, jobs, GetLabelNote(opts))
+
+	results := make([]ZipManifestEntry, len(databases))
+	queue := make(chan int)
+
+	var group sync.WaitGroup
+
+	for range jobs {
+		group.Add(1)
+
+		go func() {
+			defer group.Done()
+
+			for index := range queue {
+				results[index] = r.ZipAllDatabase(opts, source, databases[index], jobs > 1)
+			}
+		}()
+	}
+
+	for index := range databases {
+		queue <- index
+	}
+
+	close(queue)
+	group.Wait()
+
+	summary := ZipAllSummary{Label: opts.Label, Total: len(databases), Results: results}
+
+	for _, result := range results {
+		if result.Error == "" {
+			summary.Databases++
+			summary.Bytes += result.Size
+		}
+	}
+
+	summary.Elapsed = time.Since(start).Seconds()
+	summary.Manifest = filepath.Join(opts.Zip_output_folder, fmt.Sprintf("%s_%s%s_manifest.json", source.Name, FormatTimestamp(opts), GetLabelSuffix(opts)))
+
+	data, err := json.MarshalIndent(results, "", "    ")
+
+	if err != nil {
+		return summary, err
+	}
+
+	err = os.WriteFile(summary.Manifest, data, 0644)
+
+	if err != nil {
+		return summary, err
+	}
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("%d of %d databases zipped in %sm. %s written\n", summary.Databases, summary.Total, diff, FormatBytes(summary.Bytes))
+
+	for _, result := range results {
+		if result.Error != "" {
+			PRINTER.Printf("  Failed %s: %s\n", result.Database, result.Error)
+		}
+	}
+
+	PRINTER.Printf("Manifest: %s\n", summary.Manifest)
+
+	return summary, nil
+}
+
+/* Zips one database of a zip-all run. Parallel runs buffer the lines of each database and skip the table progress */
+func (r *Replicator) ZipAllDatabase(opts Options, source Connection, dbName string, parallel bool) ZipManifestEntry {
+	opts.Db = dbName
+	opts.Zip_filename = GetZipFilename(opts)
+
+	printer := PRINTER
+
+	if parallel {
+		printer = PRINTER.Buffer()
+		opts.Progress = false
+	}
+
+	defer printer.Flush()
+
+	entry := ZipManifestEntry{Database: dbName}
+
+	err := r.ZipDatabase(opts, source, printer)
+
+	if err != nil {
+		printer.Printf("%s\n", err)
+		entry.Error = err.Error()
+
+		return entry
+	}
+
+	path := filepath.Join(opts.Zip_output_folder, opts.Zip_filename)
+
+	entry.Zip = opts.Zip_filename
+	entry.Size, entry.Sha256, err = GetFileChecksum(path)
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	return entry
+}
+
+/* Returns the size and the hex sha256 of a file */
+func GetFileChecksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, file)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/* Reads back every entry of an archive, so truncated or corrupted files are detected */
+func VerifyArchive(opts Options, path string) error {
+	if opts.Format == "zstd" {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		decoder, err := zstd.NewReader(file)
+
+		if err != nil {
+			return err
+		}
+
+		defer decoder.Close()
+
+		_, err = io.Copy(io.Discard, decoder)
+
+		return err
+	}
+
+	if opts.Format == "targz" {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		gzipReader, err := gzip.NewReader(file)
+
+		if err != nil {
+			return err
+		}
+
+		tarReader := tar.NewReader(gzipReader)
+
+		for {
+			_, err := tarReader.Next()
+
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(io.Discard, tarReader); err != nil {
+				return err
+			}
+		}
+	}
+
+	archive, err := zip.OpenReader(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		reader, err := entry.Open()
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(io.Discard, reader)
+		reader.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Keeps the --rotate newest archives of the database in the output folder and removes the rest.
+Only the names of the default shape are matched, "{db}_<timestamp>.<ext>" or "{db}_<timestamp>_<label>.<ext>"
+with --label, so other databases sharing the prefix (e.g. "app_logs_" for "app") and the archives of
+other labels are left alone. Returns the removed paths
+*/
+func RotateArchives(opts Options, current string) ([]string, error) {
+	entries, err := os.ReadDir(opts.Zip_output_folder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	extension := GetLabelSuffix(opts) + "." + GetArchiveExtension(opts)
+
+	prefix := opts.Db + "_"
+	archives := []os.FileInfo{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || name == filepath.Base(current) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, extension) {
+			continue
+		}
+
+		if len(name) <= len(prefix)+len(extension) {
+			continue
+		}
+
+		/* Anything after the timestamp, like the label of another run, makes it fail to parse */
+		if _, err := time.Parse(opts.Time_format, name[len(prefix):len(name)-len(extension)]); err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return nil, err
+		}
+
+		archives = append(archives, info)
+	}
+
+	/* Newest first */
+	slices.SortFunc(archives, func(a os.FileInfo, b os.FileInfo) int {
+		return b.ModTime().Compare(a.ModTime())
+	})
+
+	removed := []string{}
+
+	/* The archive just written counts as the newest one, whatever its timestamp */
+	for _, archive := range archives[min(opts.Rotate-1, len(archives)):] {
+		path := filepath.Join(opts.Zip_output_folder, archive.Name())
+
+		err = os.Remove(path)
+
+		if err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
+
+func GetArchiveExtension(opts Options) string {
+	switch opts.Format {
+	case "targz":
+		return "tar.gz"
+	case "zstd":
+		return "sql.zst"
+	default:
+		return "zip"
+	}
+}
+
+/* Writes the sql file into an archive of the --format of the run */
+func WriteArchive(opts Options, source Connection, sqlFilePath string) error {
+	switch opts.Format {
+	case "targz":
+		return WriteTarGzArchive(opts, source, sqlFilePath)
+	case "zstd":
+		return WriteZstdArchive(opts, sqlFilePath)
+	default:
+		return WriteZipArchive(opts, sqlFilePath)
+	}
+}
+
+/* Compresses the sql file with zstd. Unlike zip and tar.gz, the result is the bare sql stream, without entries */
+func WriteZstdArchive(opts Options, sqlFilePath string) error {
+	fileReader, err := os.Open(sqlFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer fileReader.Close()
+
+	archive, err := os.Create(filepath.Join(opts.Zip_output_folder, opts.Zip_filename))
+
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	level := zstd.SpeedDefault
+
+	if opts.Zstd_level > 0 {
+		level = zstd.EncoderLevelFromZstd(opts.Zstd_level)
+	}
+
+	encoder, err := zstd.NewWriter(archive, zstd.WithEncoderLevel(level))
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(encoder, fileReader); err != nil {
+		encoder.Close()
+		return err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+/*
+Opens the sql dump of an archive made by a zip target, by its extension: the first .sql entry of a
+.zip or .tar.gz, the decoded stream of a .sql.zst, or a plain .sql file
+*/
+func OpenArchiveSql(path string) (io.ReadCloser, error) {
+	if strings.HasSuffix(path, ".zip") {
+		archive, err := zip.OpenReader(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range archive.File {
+			if strings.HasSuffix(entry.Name, ".sql") {
+				reader, err := entry.Open()
+
+				if err != nil {
+					archive.Close()
+					return nil, err
+				}
+
+				return ReadCloser{Reader: reader, closers: []io.Closer{reader, archive}}, nil
+			}
+		}
+
+		archive.Close()
+
+		return nil, fmt.Errorf("no .sql entry in %s", path)
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".sql.zst"):
+		decoder, err := zstd.NewReader(file)
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return ReadCloser{Reader: decoder, closers: []io.Closer{decoder.IOReadCloser(), file}}, nil
+	case strings.HasSuffix(path, ".tar.gz"):
+		gzipReader, err := gzip.NewReader(file)
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		tarReader := tar.NewReader(gzipReader)
+
+		for {
+			header, err := tarReader.Next()
+
+			if err == io.EOF {
+				file.Close()
+				return nil, fmt.Errorf("no .sql entry in %s", path)
+			}
+
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+
+			if strings.HasSuffix(header.Name, ".sql") {
+				return ReadCloser{Reader: tarReader, closers: []io.Closer{file}}, nil
+			}
+		}
+	case strings.HasSuffix(path, ".sql"):
+		return file, nil
+	}
+
+	file.Close()
+
+	return nil, ConfigErrorf("unknown archive type of %s, expected .zip, .tar.gz, .sql.zst or .sql", path)
+}
+
+/* Reader closing several readers and files at once, innermost first */
+type ReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r ReadCloser) Close() error {
+	var first error
+
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+/* Imports the sql dump of an archive into the opts.Db database of the opts.Target server */
+func (r *Replicator) RunRestore(opts Options) error {
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return err
+	}
+
+	if target.Read_only {
+		return ConfigErrorf("server '%s' is read-only and can't be used as target", target.Name)
+	}
+
+	reader, err := OpenArchiveSql(opts.Restore_file)
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	start := time.Now()
+
+	PRINTER.Printf("  %s ━━━▶ %s:%s\n", opts.Restore_file, target.Name, opts.Db)
+
+	PRINTER.Progress("  ┗━ Creating target database ...")
+	err = CreateTargetDatabase(opts, target, opts.Db)
+	if err != nil {
+		PRINTER.Result("  ┗━ Creating target database ... ✖\n")
+		return err
+	}
+	PRINTER.Result("  ┣━ Creating target database ... ✔")
+
+	PRINTER.Progress("  ┗━ Importing ...")
+	bytes, err := r.ImportSql(opts, target, opts.Db, reader)
+	if err != nil {
+		PRINTER.Result("  ┗━ Importing ... ✖\n")
+		return err
+	}
+	PRINTER.Result("  ┣━ Importing ... ✔")
+
+	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
+	PRINTER.Printf("  ┗━ Done in %sm. %s restored\n\n", diff, FormatBytes(bytes))
+
+	return nil
+}
+
+func WriteZipArchive(opts Options, sqlFilePath string) error {
+	/* Create zip archive */
+	archive, err := os.Create(filepath.Join(opts.Zip_output_folder, opts.Zip_filename))
+
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	zipWriter := zip.NewWriter(archive)
+
+	// Register a custom Deflate compressor.
+	zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestCompression)
+	})
+
+	comment := GetArchiveComment(opts)
+
+	if comment != "" {
+		err = zipWriter.SetComment(comment)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Read sql file */
+	fileReader, err := os.Open(sqlFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer fileReader.Close()
+
+	info, err := fileReader.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	/* Copy sql file to zip archive. A fixed modification time makes archives reproducible */
+	modified := info.ModTime()
+
+	if !opts.Mtime.IsZero() {
+		modified = opts.Mtime
+	}
+
+	archiveWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     filepath.Base(sqlFilePath),
+		Method:   zip.Deflate,
+		Modified: modified,
+		Comment:  comment,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(archiveWriter, fileReader); err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
+
+type ArchiveMetadata struct {
+	Source    string   `json:"source"`
+	Database  string   `json:"database"`
+	Timestamp string   `json:"timestamp"`
+	Version   string   `json:"version"`
+	Tables    []string `json:"tables"`
+	Sha256    string   `json:"sha256"`
+	Comment   string   `json:"comment,omitempty"`
+	Label     string   `json:"label,omitempty"`
+}
+
+/* Returns --archive-comment with its {db}, {source}, {date} and {label} tokens replaced */
+func GetArchiveComment(opts Options) string {
+	return strings.NewReplacer(
+		"{db}", opts.Db,
+		"{source}", opts.Source,
+		"{date}", FormatTimestamp(opts),
+		"{label}", opts.Label,
+	).Replace(opts.Archive_comment)
+}
+
+/* Creates a .tar.gz archive with the sql dump and a metadata.json describing it */
+func WriteTarGzArchive(opts Options, source Connection, sqlFilePath string) error {
+	tables, err := GetTableSizes(source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	metadata := ArchiveMetadata{
+		Source:    source.Name,
+		Database:  opts.Db,
+		Timestamp: Now(opts).Format(time.RFC3339),
+		Version:   VERSION,
+		Tables: lo.Map(tables, func(table TableSize, index int) string {
+			return table.Name
+		}),
+		Comment: GetArchiveComment(opts),
+		Label:   opts.Label,
+	}
+
+	slices.Sort(metadata.Tables)
+
+	/* Read sql file */
+	fileReader, err := os.Open(sqlFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer fileReader.Close()
+
+	info, err := fileReader.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	/* Create tar.gz archive */
+	archive, err := os.Create(filepath.Join(opts.Zip_output_folder, opts.Zip_filename))
+
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	gzipWriter, err := gzip.NewWriterLevel(archive, gzip.BestCompression)
+
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	/* A fixed modification time on both entries makes archives reproducible */
+	modified := info.ModTime()
+	metadataModified := time.Now()
+
+	if !opts.Mtime.IsZero() {
+		modified = opts.Mtime
+		metadataModified = opts.Mtime
+	}
+
+	/* Copy sql file to the archive while computing its checksum */
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    filepath.Base(sqlFilePath),
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: modified,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(tarWriter, hash), fileReader); err != nil {
+		return err
+	}
+
+	metadata.Sha256 = hex.EncodeToString(hash.Sum(nil))
+
+	/* Add metadata file */
+	data, err := json.MarshalIndent(metadata, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    "metadata.json",
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: metadataModified,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tarWriter.Write(data); err != nil {
+		return err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+func (r *Replicator) CopyToDb(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return err
+	}
+
+	if target.Read_only {
+		return ConfigErrorf("server '%s' is read-only and can't be used as target", target.Name)
+	}
+
+	err = CheckTargetCollation(opts, target)
+
+	if err != nil {
+		return err
+	}
+
+	if opts.Only_create_db {
+		return CreateDatabaseOnly(opts, source, target)
+	}
+
+	versions := ReportVersions(opts, source, &target)
+	PrintVersions(source, &target, versions)
+	r.Versions = &versions
+
+	if !opts.Also_zip {
+		_, err = r.ReplicateDatabaseWithRetry(opts, source, target, opts.Db, opts.Db)
+
+		return err
+	}
+
+	if !opts.Skip_space_check {
+		err = CheckDiskSpace(opts, source)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	sqlFilePath := filepath.Join(opts.Tmp_dir, fmt.Sprintf("%s_%s.sql", opts.Db, FormatTimestamp(opts)))
+	file, err := os.Create(sqlFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if !opts.Keep_sql {
+			os.Remove(sqlFilePath)
+		}
+	}()
+
+	defer file.Close()
+
+	r.Archive = file
+	defer func() { r.Archive = nil }()
+
+	_, err = r.ReplicateDatabaseWithRetry(opts, source, target, opts.Db, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	r.Archive = nil
+
+	PRINTER.Progress(fmt.Sprintf("Zipping %s ...", opts.Db))
+
+	err = WriteArchive(opts, source, sqlFilePath)
+
+	if err != nil {
+		PRINTER.Result(fmt.Sprintf("Zipping %s ... ✖.\n", opts.Db))
+		return err
+	}
+
+	PRINTER.Result(fmt.Sprintf("Zipping %s ... ✔. %s", opts.Db, filepath.Join(opts.Zip_output_folder, opts.Zip_filename)))
+
+	return nil
+}
+
+type CopySummary struct {
+	Database  string         `json:"database"`
+	Direction string         `json:"direction"`
+	Label     string         `json:"label,omitempty"`
+	Success   bool           `json:"success"`
+	Elapsed   float64        `json:"elapsed_seconds"`
+	Error     string         `json:"error,omitempty"`
+	Step      string         `json:"step,omitempty"`
+	Versions  *VersionReport `json:"versions,omitempty"`
+}
+
+/* Returns the step of a ReplicationError, or "" for other errors */
+func GetErrorStep(err error) string {
+	var replicationErr ReplicationError
+
+	if errors.As(err, &replicationErr) {
+		return string(replicationErr.Step)
+	}
+
+	return ""
+}
+
+func (r *Replicator) RunCopy(opts Options) (CopySummary, error) {
+	start := time.Now()
+
+	var err error
+
+	summary := CopySummary{Database: opts.Db, Direction: "db", Label: opts.Label}
+
+	if opts.Target == "zip" {
+		summary.Direction = "zip"
+		err = r.CopyToZip(opts)
+	} else if opts.Target == "file" {
+		summary.Direction = "file"
+		err = r.CopyToFile(opts)
+	} else {
+		err = r.CopyToDb(opts)
+	}
+
+	summary.Success = err == nil
+	summary.Elapsed = time.Since(start).Seconds()
+	summary.Versions = r.Versions
+
+	if err != nil {
+		summary.Error = err.Error()
+		summary.Step = GetErrorStep(err)
+	}
+
+	NotifyWebhook(opts, GetCopyWebhookPayload(opts, summary))
+
+	return summary, err
+}
+
+/* Json body posted to --webhook at the end of a copy or bulk run */
+type WebhookPayload struct {
+	Command   string        `json:"command"`
+	Status    string        `json:"status"`
+	Source    string        `json:"source"`
+	Target    string        `json:"target"`
+	Label     string        `json:"label,omitempty"`
+	Databases int           `json:"databases"`
+	Total     int           `json:"total"`
+	Bytes     int64         `json:"bytes"`
+	Elapsed   float64       `json:"elapsed_seconds"`
+	Results   []CopySummary `json:"results"`
+	Errors    []string      `json:"errors"`
+}
+
+func GetCopyWebhookPayload(opts Options, summary CopySummary) WebhookPayload {
+	payload := WebhookPayload{
+		Command: opts.Command,
+		Status:  "success",
+		Source:  opts.Source,
+		Target:  opts.Target,
+		Label:   opts.Label,
+		Total:   1,
+		Elapsed: summary.Elapsed,
+		Results: []CopySummary{summary},
+		Errors:  []string{},
+	}
+
+	if summary.Success {
+		payload.Databases = 1
+	} else {
+		payload.Status = "failure"
+		payload.Errors = append(payload.Errors, summary.Error)
+	}
+
+	return payload
+}
+
+/* A bulk run fails when it returns an error or stops before copying every database */
+func GetBulkWebhookPayload(opts Options, summary BulkSummary, err error) WebhookPayload {
+	payload := WebhookPayload{
+		Command:   opts.Command,
+		Status:    "success",
+		Source:    opts.Source,
+		Target:    opts.Target,
+		Label:     opts.Label,
+		Databases: summary.Databases,
+		Total:     summary.Total,
+		Bytes:     summary.Bytes,
+		Elapsed:   summary.Elapsed,
+		Results:   summary.Results,
+		Errors:    []string{},
+	}
+
+	if payload.Results == nil {
+		payload.Results = []CopySummary{}
+	}
+
+	if err != nil {
+		payload.Errors = append(payload.Errors, err.Error())
+	}
+
+	for _, result := range payload.Results {
+		if result.Error != "" {
+			payload.Errors = append(payload.Errors, fmt.Sprintf("%s: %s", result.Database, result.Error))
+		}
+	}
+
+	if len(payload.Errors) > 0 || payload.Databases < payload.Total {
+		payload.Status = "failure"
+	}
+
+	return payload
+}
+
+/* Posts the payload to opts.Webhook. Failures only print a warning, so they never change the result of the run */
+func NotifyWebhook(opts Options, payload WebhookPayload) {
+	if opts.Webhook == "" || (opts.Webhook_on == "failure" && payload.Status != "failure") {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		PRINTER.Printf("Warning: webhook not sent: %s\n", err)
+		return
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(opts.Webhook, "application/json", bytes.NewReader(data))
+
+	if err != nil {
+		PRINTER.Printf("Warning: webhook not sent: %s\n", err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		PRINTER.Printf("Warning: webhook returned %s\n", response.Status)
+	}
+}
+
+type TableSize struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+	Size int64  `json:"size"`
+}
+
+func GetTableSizes(connection Connection, dbName string) ([]TableSize, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	rows, err := sql.Query(`
+		SELECT TABLE_NAME, COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH, 0) + COALESCE(INDEX_LENGTH, 0) AS SIZE
+		FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE'
+		ORDER BY SIZE DESC, TABLE_NAME`, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tables := []TableSize{}
+
+	for rows.Next() {
+		table := TableSize{}
+
+		err = rows.Scan(&table.Name, &table.Rows, &table.Size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+func RunTables(opts Options) error {
+	server, err := FindServer(opts.Source, "server")
+
+	if err != nil {
+		return err
+	}
+
+	tables, err := GetTableSizes(server, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	if len(tables) == 0 {
+		return fmt.Errorf("database '%s' has no tables or does not exist", opts.Db)
+	}
+
+	if opts.Top > 0 && opts.Top < len(tables) {
+		tables = tables[:opts.Top]
+	}
+
+	if opts.Output == "json" {
+		return PrintJson(tables)
+	}
+
+	if opts.Output == "csv" {
+		rows := [][]string{{"table", "rows", "size"}}
+
+		for _, table := range tables {
+			rows = append(rows, []string{table.Name, strconv.FormatInt(table.Rows, 10), strconv.FormatInt(table.Size, 10)})
+		}
+
+		return PrintCsv(rows)
+	}
+
+	fmt.Printf("%-48s %14s %12s\n", "TABLE", "ROWS", "SIZE")
+
+	for _, table := range tables {
+		fmt.Printf("%-48s %14d %12s\n", table.Name, table.Rows, FormatBytes(table.Size))
+	}
+
+	return nil
+}
+
+/* Prints a value as indented json on stdout, for --output json */
+func PrintJson(value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
+
+/* Prints rows as csv on stdout, the first row being the header, for --output csv */
+func PrintCsv(rows [][]string) error {
+	writer := csv.NewWriter(os.Stdout)
+	writer.WriteAll(rows)
+
+	return writer.Error()
+}
+
+/* Returns the data size of the tables a dump would copy with their data, and the number of tables */
+func EstimateDumpSize(opts Options, connection Connection, dbName string) (int64, int, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer CloseConnection(sql)
+
+	rows, err := sql.Query("SELECT TABLE_NAME, COALESCE(DATA_LENGTH, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE'", dbName)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer rows.Close()
+
+	schemaOnlyTables := GetSchemaOnlyTables(opts)
+
+	var size int64
+	tables := 0
+
+	for rows.Next() {
+		var name string
+		var length int64
+
+		err = rows.Scan(&name, &length)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		tables++
+
+		if !slices.Contains(schemaOnlyTables, name) {
+			size += length
+		}
+	}
+
+	return size, tables, rows.Err()
+}
+
+func GetCompressionRatio() float64 {
+	if CONFIG.Compression_ratio <= 0 {
+		return 0.15
+	}
+
+	return CONFIG.Compression_ratio
+}
+
+/* Sums the data length of the tables that would be dumped with data */
+func RunEstimate(opts Options) error {
+	server, err := FindServer(opts.Source, "server")
+
+	if err != nil {
+		return err
+	}
+
+	size, tables, err := EstimateDumpSize(opts, server, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	if tables == 0 {
+		return fmt.Errorf("database '%s' has no tables or does not exist", opts.Db)
+	}
+
+	ratio := GetCompressionRatio()
+
+	fmt.Printf("Estimated dump size:       %s\n", FormatBytes(size))
+	fmt.Printf("Estimated compressed size: %s (ratio %.2f)\n", FormatBytes(int64(float64(size)*ratio)), ratio)
+
+	return nil
+}
+
+/*
+Checks before a zip dump that the temp folder can hold the sql file and the output folder the
+archive, using the estimated sizes. Skipped where free space can't be read
+*/
+func CheckDiskSpace(opts Options, source Connection) error {
+	size, _, err := EstimateDumpSize(opts, source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	needs := []struct {
+		folder string
+		size   int64
+	}{
+		{opts.Tmp_dir, size},
+		{opts.Zip_output_folder, int64(float64(size) * GetCompressionRatio())},
+	}
+
+	for _, need := range needs {
+		free, err := GetFreeSpace(need.folder)
+
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if free < need.size {
+			return fmt.Errorf("not enough space in %s: %s needed, %s available, %s short (use --skip-space-check to try anyway)", need.folder, FormatBytes(need.size), FormatBytes(free), FormatBytes(need.size-free))
+		}
+	}
+
+	return nil
+}
+
+/* Programs that must be available in PATH to run the command */
+func GetRequiredPrograms(opts Options) []string {
+	if opts.Command == "restore" {
+		return []string{"mysql"}
+	}
+
+	if !slices.Contains([]string{"bulk", "copy", "copy-routines", "zip-all"}, opts.Command) {
+		return []string{}
+	}
+
+	programs := []string{opts.Dumper}
+
+	if opts.Views_last && opts.Dumper != "mysqldump" {
+		programs = append(programs, "mysqldump")
+	}
+
+	/* Dumps of a source behind ssh run on the ssh host */
+	if slices.ContainsFunc(CONFIG.Servers, func(c Connection) bool { return c.Name == opts.Source && c.Ssh_host != "" }) {
+		programs = []string{"ssh"}
+	}
+
+	if opts.Command == "bulk" || !slices.Contains([]string{"zip", "file"}, opts.Target) {
+		programs = append(programs, "mysql")
+	}
+
+	return programs
+}
+
+func CheckRequiredPrograms(programs []string) error {
+	missing := lo.Filter(programs, func(program string, index int) bool {
+		_, err := exec.LookPath(program)
+
+		return err != nil
+	})
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return ConfigErrorf("%s not found in PATH. Install the MySQL client programs from https://dev.mysql.com/downloads/ and make sure they are in PATH\nPATH=%s", strings.Join(missing, ", "), os.Getenv("PATH"))
+}
+
+/* Computes CHECKSUM TABLE for every base table. A nil checksum means the table doesn't exist */
+func GetTableChecksums(connection Connection, dbName string) (map[string]*int64, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	tables, err := GetTableSizes(connection, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := map[string]*int64{}
+
+	for _, table := range tables {
+		var name string
+		var checksum *int64
+
+		err = sql.QueryRow(fmt.Sprintf("CHECKSUM TABLE %s.%s", QuoteIdentifier(dbName), QuoteIdentifier(table.Name))).Scan(&name, &checksum)
+
+		if err != nil {
+			return nil, err
+		}
+
+		checksums[table.Name] = checksum
+	}
+
+	return checksums, nil
+}
+
+/* Returns the source tables whose checksum matches the one of the same table on the target */
+func GetUnchangedTables(opts Options, source Connection, target Connection, sourceDB string, targetDB string) ([]string, error) {
+	sourceChecksums, err := GetTableChecksums(source, sourceDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	/* A missing target database has no tables, so everything is copied */
+	targetChecksums, err := GetTableChecksums(target, targetDB)
+
+	if err != nil {
+		return nil, err
+	}
+
+	schemaOnlyTables := GetSchemaOnlyTables(opts)
+	unchanged := []string{}
+
+	for table, sourceChecksum := range sourceChecksums {
+		if slices.Contains(schemaOnlyTables, table) {
+			continue
+		}
+
+		targetChecksum, ok := targetChecksums[table]
+
+		if ok && sourceChecksum != nil && targetChecksum != nil && *sourceChecksum == *targetChecksum {
+			unchanged = append(unchanged, table)
+		}
+	}
+
+	slices.Sort(unchanged)
+
+	return unchanged, nil
+}
+
+/* Prints a titled list of names, or nothing when it's empty */
+func PrintExplainSection(title string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	fmt.Printf("\n%s (%d):\n", title, len(names))
+
+	for _, name := range names {
+		fmt.Printf("  %s\n", name)
+	}
+}
+
+/*
+Shows what a copy would do with the tables of the source, without dumping anything: the tables
+dumped with data, schema-only or with selected rows, the skipped tables and views, the post-process
+queries, and the config entries naming tables that don't exist in the source
+*/
+func RunExplain(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	/* Zip targets always dump every table with its data */
+	if opts.Target == "zip" {
+		opts.Use_empty_tables = false
+	}
+
+	tables, err := GetTableSizes(source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	if len(tables) == 0 {
+		return fmt.Errorf("database '%s' has no tables or does not exist", opts.Db)
+	}
+
+	views, err := GetViews(source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	names := lo.Map(tables, func(table TableSize, index int) string { return table.Name })
+	slices.Sort(names)
+
+	opts.Large_tables = lo.Map(GetLargeTables(opts, tables), func(table TableSize, index int) string { return table.Name })
+	opts.Non_data_tables = GetNonDataTables(opts, names)
+
+	schemaOnly := GetSchemaOnlyTables(opts)
+	selected := GetSelectedTables(opts)
+
+	data := []string{}
+	empty := []string{}
+	rows := []string{}
+	skipped := []string{}
+
+	for _, table := range names {
+		if opts.Merge && !slices.Contains(opts.Tables, table) {
+			skipped = append(skipped, fmt.Sprintf("%s (not in --tables)", table))
+		} else if slices.Contains(selected, table) {
+			details := []string{}
+
+			if partitions, ok := CONFIG.Partitions[table]; ok {
+				details = append(details, fmt.Sprintf("partitions %s", strings.Join(partitions, ", ")))
+			}
+
+			if columns, ok := CONFIG.Exclude_columns[table]; ok {
+				details = append(details, fmt.Sprintf("without %s", strings.Join(columns, ", ")))
+			}
+
+			rows = append(rows, fmt.Sprintf("%s (%s)", table, strings.Join(details, "; ")))
+		} else if slices.Contains(opts.Large_tables, table) {
+			empty = append(empty, fmt.Sprintf("%s (over --max-table-size)", table))
+		} else if slices.Contains(opts.Non_data_tables, table) && !slices.Contains(CONFIG.Empty_tables, table) {
+			empty = append(empty, fmt.Sprintf("%s (not in Data_tables)", table))
+		} else if slices.Contains(schemaOnly, table) {
+			empty = append(empty, table)
+		} else {
+			data = append(data, table)
+		}
+	}
+
+	for _, view := range views {
+		if opts.No_views {
+			skipped = append(skipped, fmt.Sprintf("%s (view, --no-views)", view))
+		} else if opts.Merge {
+			skipped = append(skipped, fmt.Sprintf("%s (view, --merge)", view))
+		} else if opts.Views_last {
+			data = append(data, fmt.Sprintf("%s (view, final pass)", view))
+		} else {
+			data = append(data, fmt.Sprintf("%s (view)", view))
+		}
+	}
+
+	/* Config entries that match nothing are usually typos or tables dropped since */
+	missing := []string{}
+	existing := append(slices.Clone(names), views...)
+
+	for _, table := range CONFIG.Empty_tables {
+		if !slices.Contains(existing, table) {
+			missing = append(missing, fmt.Sprintf("Empty_tables: %s", table))
+		}
+	}
+
+	for _, table := range GetDataTables(opts) {
+		if !slices.Contains(existing, table) {
+			missing = append(missing, fmt.Sprintf("Data_tables: %s", table))
+		}
+	}
+
+	for _, table := range lo.Keys(CONFIG.Partitions) {
+		if !slices.Contains(existing, table) {
+			missing = append(missing, fmt.Sprintf("Partitions: %s", table))
+		}
+	}
+
+	for _, table := range lo.Keys(CONFIG.Exclude_columns) {
+		if !slices.Contains(existing, table) {
+			missing = append(missing, fmt.Sprintf("Exclude_columns: %s", table))
+		}
+	}
+
+	slices.Sort(missing)
+
+	queries := []string{}
+
+	if opts.Use_empty_tables {
+		for _, query := range CONFIG.Pre_process_queries {
+			queries = append(queries, fmt.Sprintf("%s (on the source, as {pre:%s})", query.Query, query.Name))
+		}
+
+		for _, query := range GetPostProcessQueries(opts) {
+			if query.Batch_size > 0 {
+				queries = append(queries, fmt.Sprintf("%s (in batches of %d rows)", query.Query, query.Batch_size))
+			} else {
+				queries = append(queries, query.Query)
+			}
+		}
+	}
+
+	fmt.Printf("%s:%s, %d tables and %d views\n", source.Name, opts.Db, len(tables), len(views))
+
+	PrintExplainSection("Dumped with data", data)
+	PrintExplainSection("Schema only", empty)
+	PrintExplainSection("Selected rows", rows)
+	PrintExplainSection("Skipped", skipped)
+	PrintExplainSection("Post-process queries", queries)
+	PrintExplainSection("Config entries not found in the source", missing)
+
+	if opts.Only_changed {
+		fmt.Println("\nWith --only-changed, the tables with the same checksum on the target are also skipped")
+	}
+
+	return nil
+}
+
+func RunVerify(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verifying %s:%s ━━━▶ %s:%s\n", source.Name, opts.Db, target.Name, opts.Db)
+
+	sourceChecksums, err := GetTableChecksums(source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	targetChecksums, err := GetTableChecksums(target, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	schemaOnlyTables := GetSchemaOnlyTables(opts)
+
+	tables := lo.Uniq(append(lo.Keys(sourceChecksums), lo.Keys(targetChecksums)...))
+	slices.Sort(tables)
+
+	mismatches := 0
+
+	for _, table := range tables {
+		if slices.Contains(schemaOnlyTables, table) {
+			continue
+		}
+
+		sourceChecksum, inSource := sourceChecksums[table]
+		targetChecksum, inTarget := targetChecksums[table]
+
+		if !inTarget {
+			fmt.Printf("  ✖ %s: missing on target\n", table)
+			mismatches++
+		} else if !inSource {
+			fmt.Printf("  ✖ %s: missing on source\n", table)
+			mismatches++
+		} else if sourceChecksum == nil || targetChecksum == nil || *sourceChecksum != *targetChecksum {
+			fmt.Printf("  ✖ %s: checksum mismatch\n", table)
+			mismatches++
+		}
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d tables differ", mismatches, len(tables))
+	}
+
+	fmt.Printf("All %d tables match\n", len(tables))
+
+	return nil
+}
+
+/* Parsed SHOW CREATE TABLE of a table, as compared by migrate-schema */
+type TableSchema struct {
+	Create      string
+	Columns     []string
+	Definitions map[string]string
+	Keys        map[string]string
+	Constraints map[string]string
+	Options     string
+}
+
+var SCHEMA_COLUMN_REGEX = regexp.MustCompile("^`((?:[^`]|``)+)` (.*)$")
+var SCHEMA_KEY_REGEX = regexp.MustCompile("^(?:UNIQUE |FULLTEXT |SPATIAL )?KEY `((?:[^`]|``)+)`")
+var SCHEMA_CONSTRAINT_REGEX = regexp.MustCompile("^CONSTRAINT `((?:[^`]|``)+)`")
+var AUTO_INCREMENT_REGEX = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+var INTEGER_WIDTH_REGEX = regexp.MustCompile(`^((?:tiny|small|medium|big)?int)\(\d+\)`)
+
+/* Splits a SHOW CREATE TABLE statement into its columns, keys, constraints and table options */
+func ParseTableSchema(create string) TableSchema {
+	create = AUTO_INCREMENT_REGEX.ReplaceAllString(create, "")
+
+	schema := TableSchema{
+		Create:      create,
+		Columns:     []string{},
+		Definitions: map[string]string{},
+		Keys:        map[string]string{},
+		Constraints: map[string]string{},
+	}
+
+	lines := strings.Split(create, "\n")
+
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+
+		if strings.HasPrefix(line, ")") {
+			schema.Options = strings.TrimSpace(strings.TrimPrefix(line, ")"))
+			continue
+		}
+
+		if match := SCHEMA_COLUMN_REGEX.FindStringSubmatch(line); match != nil {
+			name := strings.ReplaceAll(match[1], "``", "`")
+			schema.Columns = append(schema.Columns, name)
+			schema.Definitions[name] = match[2]
+		} else if strings.HasPrefix(line, "PRIMARY KEY") {
+			schema.Keys["PRIMARY"] = line
+		} else if match := SCHEMA_KEY_REGEX.FindStringSubmatch(line); match != nil {
+			schema.Keys[strings.ReplaceAll(match[1], "``", "`")] = line
+		} else if match := SCHEMA_CONSTRAINT_REGEX.FindStringSubmatch(line); match != nil {
+			schema.Constraints[strings.ReplaceAll(match[1], "``", "`")] = line
+		} else if line != "" {
+			schema.Constraints[line] = line
+		}
+	}
+
+	return schema
+}
+
+/* Servers of different versions print integer display widths differently, so they are ignored */
+func NormalizeColumnDefinition(definition string) string {
+	return INTEGER_WIDTH_REGEX.ReplaceAllString(definition, "$1")
+}
+
+/* Returns the parsed schema of every base table of a database */
+func GetTableSchemas(connection Connection, dbName string) (map[string]TableSchema, error) {
+	tables, err := GetTableSizes(connection, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseConnection(sql)
+
+	schemas := map[string]TableSchema{}
+
+	for _, table := range tables {
+		var name, create string
+
+		err = sql.QueryRow(fmt.Sprintf("SHOW CREATE TABLE %s.%s", QuoteIdentifier(dbName), QuoteIdentifier(table.Name))).Scan(&name, &create)
+
+		if err != nil {
+			return nil, err
+		}
+
+		schemas[table.Name] = ParseTableSchema(create)
+	}
+
+	return schemas, nil
+}
+
+/*
+Returns the statements that bring the tables of the target to the schema of the source, and the differences they don't cover.
+Missing tables are created, and columns and keys are added, modified or dropped. Tables only on the target are never dropped,
+and changed constraints and table options are only reported
+*/
+func GetSchemaMigration(source map[string]TableSchema, target map[string]TableSchema) ([]string, []string) {
+	statements := []string{}
+	unsupported := []string{}
+
+	tables := lo.Keys(source)
+	slices.Sort(tables)
+
+	for _, table := range tables {
+		sourceSchema := source[table]
+		targetSchema, exists := target[table]
+
+		if !exists {
+			statements = append(statements, sourceSchema.Create)
+			continue
+		}
+
+		clauses := []string{}
+
+		keys := lo.Uniq(append(lo.Keys(sourceSchema.Keys), lo.Keys(targetSchema.Keys)...))
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			targetKey, inTarget := targetSchema.Keys[key]
+
+			if !inTarget || sourceSchema.Keys[key] == targetKey {
+				continue
+			}
+
+			if key == "PRIMARY" {
+				clauses = append(clauses, "DROP PRIMARY KEY")
+			} else {
+				clauses = append(clauses, "DROP INDEX "+QuoteIdentifier(key))
+			}
+		}
+
+		for _, column := range targetSchema.Columns {
+			if _, inSource := sourceSchema.Definitions[column]; !inSource {
+				clauses = append(clauses, "DROP COLUMN "+QuoteIdentifier(column))
+			}
+		}
+
+		for i, column := range sourceSchema.Columns {
+			definition := sourceSchema.Definitions[column]
+			targetDefinition, inTarget := targetSchema.Definitions[column]
+
+			if !inTarget {
+				position := "FIRST"
+
+				if i > 0 {
+					position = "AFTER " + QuoteIdentifier(sourceSchema.Columns[i-1])
+				}
+
+				clauses = append(clauses, fmt.Sprintf("ADD COLUMN %s %s %s", QuoteIdentifier(column), definition, position))
+			} else if NormalizeColumnDefinition(definition) != NormalizeColumnDefinition(targetDefinition) {
+				clauses = append(clauses, fmt.Sprintf("MODIFY COLUMN %s %s", QuoteIdentifier(column), definition))
+			}
+		}
+
+		for _, key := range keys {
+			sourceKey, inSource := sourceSchema.Keys[key]
+
+			if inSource && sourceKey != targetSchema.Keys[key] {
+				clauses = append(clauses, "ADD "+sourceKey)
+			}
+		}
+
+		if len(clauses) > 0 {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s %s", QuoteIdentifier(table), strings.Join(clauses, ", ")))
+		}
+
+		constraints := lo.Uniq(append(lo.Keys(sourceSchema.Constraints), lo.Keys(targetSchema.Constraints)...))
+		slices.Sort(constraints)
+
+		for _, constraint := range constraints {
+			if sourceSchema.Constraints[constraint] != targetSchema.Constraints[constraint] {
+				unsupported = append(unsupported, fmt.Sprintf("%s: constraint %s differs", table, constraint))
+			}
+		}
+
+		if sourceSchema.Options != targetSchema.Options {
+			unsupported = append(unsupported, fmt.Sprintf("%s: table options differ (source %s, target %s)", table, sourceSchema.Options, targetSchema.Options))
+		}
+	}
+
+	for _, table := range lo.Keys(target) {
+		if _, exists := source[table]; !exists {
+			unsupported = append(unsupported, fmt.Sprintf("%s: only on the target, not dropped", table))
+		}
+	}
+
+	slices.Sort(unsupported)
+
+	return statements, unsupported
+}
+
+/* Applies to the target database the schema changes of the source database, keeping its data */
+func RunMigrateSchema(opts Options) error {
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	if source.Ssh_host != "" {
+		return ConfigErrorf("the schema of a source behind Ssh_host can't be read")
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := FindServer(opts.Target, "target")
+
+	if err != nil {
+		return err
+	}
+
+	if target.Read_only && !opts.Dry_run {
+		return ConfigErrorf("server '%s' is read-only and can't be used as target", target.Name)
+	}
+
+	databases, err := GetDatabasesLike(target, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(databases, opts.Db) {
+		return fmt.Errorf("database %s not found on %s, copy it instead", opts.Db, target.Name)
+	}
+
+	PRINTER.Printf("Migrating schema %s:%s ━━━▶ %s:%s\n", source.Name, opts.Db, target.Name, opts.Db)
+
+	sourceSchemas, err := GetTableSchemas(source, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	targetSchemas, err := GetTableSchemas(target, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	statements, unsupported := GetSchemaMigration(sourceSchemas, targetSchemas)
+
+	for _, difference := range unsupported {
+		PRINTER.Printf("  Not migrated: %s\n", difference)
+	}
+
+	if len(statements) == 0 {
+		PRINTER.Printf("Schemas already match\n")
+		return nil
+	}
+
+	/* The statements are the output of a dry run, so they are printed even when PRINTER is quiet */
+	if opts.Dry_run {
+		for _, statement := range statements {
+			fmt.Printf("%s;\n", statement)
+		}
+
+		return nil
+	}
+
+	db, err := OpenDatabaseConnection(target, opts.Db)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	/* Created tables may reference each other */
+	_, err = conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=0")
+
+	if err != nil {
+		return err
+	}
+
+	for i, statement := range statements {
+		_, err = conn.ExecContext(context.Background(), statement)
+
+		if err != nil {
+			return fmt.Errorf("%s: %w (%d of %d statements applied)", statement, err, i, len(statements))
+		}
+	}
+
+	PRINTER.Printf("%d statements applied\n", len(statements))
+
+	return nil
+}
+
+/* Returns the current time, in UTC with --utc */
+func Now(opts Options) time.Time {
+	if opts.Utc {
+		return time.Now().UTC()
+	}
+
+	return time.Now()
+}
+
+/* Formats the current time for filenames with the --time-format layout */
+func FormatTimestamp(opts Options) string {
+	return Now(opts).Format(opts.Time_format)
+}
+
+/* Sets CONFIG from config and merges the config fields, host overrides and defaults into opts */
+func ResolveConfig(config Config, opts Options) (Options, error) {
+	CONFIG = config
+	CONFIG.Servers = slices.Clone(config.Servers)
+
+	err := ApplyHostOverrides(opts)
+
+	if err != nil {
+		return opts, err
+	}
+
+	return ApplyConfigDefaults(opts), nil
+}
+
+/* Reads the config files in order, merging each one into the previous ones, and validates the result */
+func LoadConfig(paths []string) (Config, error) {
+	merged := map[string]json.RawMessage{}
+
+	for _, path := range paths {
+		data, err := ReadConfigFile(path)
+
+		if err != nil {
+			return Config{}, ConfigError{Err: err}
+		}
+
+		if path == "-" {
+			path = "stdin"
+		}
+
+		overlay := map[string]json.RawMessage{}
+
+		err = json.Unmarshal(data, &overlay)
+
+		if err != nil {
+			return Config{}, ConfigErrorf("%s: %w", path, err)
+		}
+
+		merged, err = MergeConfigJson(merged, overlay)
+
+		if err != nil {
+			return Config{}, ConfigErrorf("%s: %w", path, err)
+		}
+	}
+
+	data, err := json.Marshal(merged)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{}
+
+	err = json.Unmarshal(data, &config)
+
+	if err != nil {
+		return Config{}, ConfigErrorf("%s: %w", strings.Join(paths, " + "), err)
+	}
+
+	return config, ValidateConfig(config)
+}
+
+/* Reads a config file, or the standard input for "-", so generated configs never touch the disk */
+func ReadConfigFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(path)
+}
+
+/*
+Merges the fields of an overlay config into a base one. Servers are merged by Name: the fields of an overlay
+server override the ones of the base server with the same Name, and other servers are added. Partitions and
+Exclude_columns are merged by table. Every other field, lists included, is replaced by the overlay
+*/
+func MergeConfigJson(base map[string]json.RawMessage, overlay map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	merged := maps.Clone(base)
+
+	for key, value := range overlay {
+		var err error
+
+		switch key {
+		case "Servers":
+			merged[key], err = MergeServersJson(base[key], value)
+		case "Partitions", "Exclude_columns":
+			merged[key], err = MergeObjectsJson(base[key], value)
+		default:
+			merged[key] = value
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return merged, nil
+}
+
+func MergeServersJson(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	servers := []map[string]json.RawMessage{}
+	overlayServers := []map[string]json.RawMessage{}
+
+	if base != nil {
+		if err := json.Unmarshal(base, &servers); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(overlay, &overlayServers); err != nil {
+		return nil, err
+	}
+
+	/* Only servers of the base are merged into, so a server defined twice in one file is reported by ValidateConfig */
+	count := len(servers)
+
+	for _, server := range overlayServers {
+		var name string
+
+		if err := json.Unmarshal(server["Name"], &name); err != nil || name == "" {
+			return nil, fmt.Errorf("every server needs a Name to be merged")
+		}
+
+		index := slices.IndexFunc(servers[:count], func(existing map[string]json.RawMessage) bool {
+			var existingName string
+
+			return json.Unmarshal(existing["Name"], &existingName) == nil && existingName == name
+		})
+
+		if index == -1 {
+			servers = append(servers, server)
+		} else {
+			maps.Copy(servers[index], server)
+		}
+	}
+
+	return json.Marshal(servers)
+}
+
+func MergeObjectsJson(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	object := map[string]json.RawMessage{}
+	overlayObject := map[string]json.RawMessage{}
+
+	if base != nil {
+		if err := json.Unmarshal(base, &object); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(overlay, &overlayObject); err != nil {
+		return nil, err
+	}
+
+	maps.Copy(object, overlayObject)
+
+	return json.Marshal(object)
+}
+
+/* Checks the config as a whole, once every file is merged */
+func ValidateConfig(config Config) error {
+	problems := []string{}
+	names := []string{}
+
+	for i, server := range config.Servers {
+		if server.Name == "" {
+			problems = append(problems, fmt.Sprintf("server %d has no Name", i+1))
+		} else if slices.Contains(names, server.Name) {
+			problems = append(problems, fmt.Sprintf("server '%s' is defined twice", server.Name))
+		}
+
+		names = append(names, server.Name)
+
+		if !slices.Contains([]string{"", "auto", "ipv4", "ipv6"}, server.Address_family) {
+			problems = append(problems, fmt.Sprintf("server '%s' has an invalid Address_family '%s', expected auto, ipv4 or ipv6", server.Name, server.Address_family))
+		}
+
+		if server.Charset != "" && !CHARSET_REGEXP.MatchString(server.Charset) {
+			problems = append(problems, fmt.Sprintf("server '%s' has an invalid Charset '%s', only letters, digits and '_' are allowed", server.Name, server.Charset))
+		}
+	}
+
+	for _, transaction := range config.Transactions {
+		if len(transaction) < 1 || len(transaction) > 2 {
+			problems = append(problems, fmt.Sprintf("transaction %q must have a source and an optional target", transaction))
+		}
+	}
+
+	for i, query := range config.Post_process_queries {
+		if strings.TrimSpace(query.Query) == "" {
+			problems = append(problems, fmt.Sprintf("post-process query %d is empty", i+1))
+		}
+	}
+
+	preNames := []string{}
+
+	for i, query := range config.Pre_process_queries {
+		if !PRE_PROCESS_NAME_REGEXP.MatchString(query.Name) {
+			problems = append(problems, fmt.Sprintf("pre-process query %d needs a Name of letters, digits and _", i+1))
+		} else if slices.Contains(preNames, query.Name) {
+			problems = append(problems, fmt.Sprintf("pre-process query '%s' is defined twice", query.Name))
+		} else if err := ValidatePreProcessQuery(query); err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		preNames = append(preNames, query.Name)
+	}
+
+	if len(problems) > 0 {
+		return ConfigErrorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+/* Config and options in effect for a run, as printed by --print-config */
+type EffectiveConfig struct {
+	Config  Config
+	Options Options
+}
+
+/* Writes the resolved config and options of a run as json to w, with the passwords redacted, without running anything */
+func PrintConfig(config Config, opts Options, w io.Writer) error {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts, err := ResolveConfig(config, opts)
+
+	if err != nil {
+		return err
+	}
+
+	effective := EffectiveConfig{Config: CONFIG, Options: opts}
+
+	/* The servers are redacted on a copy, CONFIG keeps the real passwords */
+	effective.Config.Servers = slices.Clone(CONFIG.Servers)
+
+	for i, server := range effective.Config.Servers {
+		if server.Password != "" {
+			effective.Config.Servers[i].Password = "********"
+		}
+	}
+
+	data, err := json.MarshalIndent(effective, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+
+	return err
+}
+
+/* Fills the options left unset by the command line with the config defaults */
+func ApplyConfigDefaults(opts Options) Options {
+	/* Library callers may leave the values the command line always sets */
+	if opts.Dumper == "" {
+		opts.Dumper = "mysqldump"
+	}
+
+	if opts.Format == "" {
+		opts.Format = "zip"
+	}
+
+	if opts.On_exists == "" {
+		opts.On_exists = "drop"
+	}
+
+	if opts.Gtid_purged == "" {
+		opts.Gtid_purged = "OFF"
+	}
+
+	if opts.Lock_mode == "" {
+		opts.Lock_mode = "transaction"
+	}
+
+	if opts.Zip_output_folder == "" {
+		opts.Zip_output_folder = CONFIG.Zip_output_folder
+	}
+
+	if opts.Zip_output_folder == "" {
+		opts.Zip_output_folder = "."
+	}
+
+	if opts.Tmp_dir == "" {
+		opts.Tmp_dir = os.TempDir()
+	}
+
+	opts.Utc = opts.Utc || CONFIG.Utc
+
+	if opts.Time_format == "" {
+		opts.Time_format = CONFIG.Time_format
+	}
+
+	if opts.Time_format == "" {
+		opts.Time_format = "2006_01_02_15_04_05"
+	}
+
+	if opts.Zip_filename == "" {
+		opts.Zip_filename = GetZipFilename(opts)
+	}
+
+	return opts
+}
+
+/* Returns the archive name of opts.Db, from the Zip_filename_template of the config when there is one */
+func GetZipFilename(opts Options) string {
+	if CONFIG.Zip_filename_template != "" {
+		return strings.NewReplacer(
+			"{db}", opts.Db,
+			"{source}", opts.Source,
+			"{date}", FormatTimestamp(opts),
+			"{label}", opts.Label,
+		).Replace(CONFIG.Zip_filename_template)
+	}
+
+	return fmt.Sprintf("%s_%s%s.%s", opts.Db, FormatTimestamp(opts), GetLabelSuffix(opts), GetArchiveExtension(opts))
+}
+
+/* Labels end up in filenames, so they are limited to characters safe on every filesystem */
+var LABEL_REGEXP = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+/* Returns the end of the default filenames for --label, e.g. "_nightly", or "" without a label */
+func GetLabelSuffix(opts Options) string {
+	if opts.Label == "" {
+		return ""
+	}
+
+	return "_" + opts.Label
+}
+
+/* Returns the note added to the log lines of a run for --label, e.g. " [nightly]" */
+func GetLabelNote(opts Options) string {
+	if opts.Label == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" [%s]", opts.Label)
+}
+
+/*
+Prepares a run: the config becomes the current one, host overrides and config defaults are
+applied and the required programs are checked. The config is shared by the whole package, so
+callers of Setup itself must not run concurrently; the entry points below hold RUN_MUTEX for that
+*/
+func Setup(config Config, opts Options) (Options, error) {
+	opts, err := ResolveConfig(config, opts)
+
+	if err != nil {
+		return opts, err
+	}
+
+	err = CheckRequiredPrograms(GetRequiredPrograms(opts))
+
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+/*
+Copies opts.Db from the opts.Source server to the opts.Target server, into an archive when the target
+is "zip", or into the sql file opts.Sql_file when it's "file"
+*/
+func Copy(config Config, opts Options) (CopySummary, error) {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "copy"
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		summary := CopySummary{Database: opts.Db, Direction: "db", Label: opts.Label, Error: err.Error()}
+
+		if opts.Target == "zip" || opts.Target == "file" {
+			summary.Direction = opts.Target
+		}
+
+		return summary, err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.RunCopy(opts)
+}
+
+/* Copies every database of the config Transactions from the opts.Source server to the opts.Target server */
+func Bulk(config Config, opts Options) (BulkSummary, error) {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "bulk"
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		return BulkSummary{}, err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.RunBulk(opts)
+}
+
+/* Streams the dump of opts.Db on the opts.Source server into w */
+func Dump(config Config, opts Options, w io.Writer) error {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		return err
+	}
+
+	source, err := FindServer(opts.Source, "source")
+
+	if err != nil {
+		return err
+	}
+
+	source, err = ResolveSourceHost(opts, source)
+
+	if err != nil {
+		return err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.DumpToWriter(opts, source, opts.Db, w)
+}
+
+/* Prints what a copy of opts.Db would do with its tables, without dumping anything */
+func Explain(config Config, opts Options) error {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "copy"
+
+	opts, err := ResolveConfig(config, opts)
+
+	if err != nil {
+		return err
+	}
+
+	return RunExplain(opts)
+}
+
+/* Zips every non-system database of the opts.Source server into its own archive in opts.Zip_output_folder */
+func ZipAll(config Config, opts Options) (ZipAllSummary, error) {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "zip-all"
+	opts.Target = "zip"
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		return ZipAllSummary{}, err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.RunZipAll(opts)
+}
+
+/* Imports the archive opts.Restore_file into opts.Db on the opts.Target server */
+func Restore(config Config, opts Options) error {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "restore"
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		return err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.RunRestore(opts)
+}
+
+/* Replaces the routines of opts.Db on the opts.Target server with the ones on the opts.Source server */
+func CopyRoutines(config Config, opts Options) error {
+	RUN_MUTEX.Lock()
+	defer RUN_MUTEX.Unlock()
+
+	opts.Command = "copy-routines"
+
+	opts, err := Setup(config, opts)
+
+	if err != nil {
+		return err
+	}
+
+	replicator := &Replicator{Runner: ExecRunner{}}
+
+	return replicator.RunCopyRoutines(opts)
+}
+
+var CLIENT_VERSION_REGEXP = regexp.MustCompile(`Ver (\S+)(?: Distrib ([^\s,]+))?`)
+
+var VERSION_NUMBER_REGEXP = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+/* Client programs and servers of a run, with the mismatches found between them */
+type VersionReport struct {
+	Dumper   string   `json:"dumper"`
+	Client   string   `json:"client"`
+	Mysql    string   `json:"mysql,omitempty"`
+	Source   string   `json:"source"`
+	Target   string   `json:"target,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+/* Runs program --version where the dumps of connection run, and returns its version */
+func GetClientVersion(connection Connection, program string) (string, error) {
+	output, err := GetSourceCommand(connection, program, []string{"--version"}).Output()
+
+	if err != nil {
+		return "", fmt.Errorf("%s --version failed: %w", program, err)
+	}
+
+	/* Before 8.0 the real version follows Distrib, e.g. "Ver 10.13 Distrib 5.7.44, for Linux" */
+	match := CLIENT_VERSION_REGEXP.FindStringSubmatch(string(output))
+
+	if match == nil {
+		return "", fmt.Errorf("unexpected %s --version output: %s", program, strings.TrimSpace(string(output)))
+	}
+
+	if match[2] != "" {
+		return match[2], nil
+	}
+
+	return match[1], nil
+}
+
+func GetServerVersion(connection Connection) (string, error) {
+	sql, err := OpenConnection(connection)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer CloseConnection(sql)
+
+	var version string
+
+	err = sql.QueryRow("SELECT VERSION()").Scan(&version)
+
+	if err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+/* Compares the major and minor numbers of two versions. Reports false when either can't be parsed */
+func IsOlderVersion(version string, than string) (bool, bool) {
+	a := VERSION_NUMBER_REGEXP.FindStringSubmatch(version)
+	b := VERSION_NUMBER_REGEXP.FindStringSubmatch(than)
+
+	if a == nil || b == nil {
+		return false, false
+	}
+
+	aMajor, _ := strconv.Atoi(a[1])
+	aMinor, _ := strconv.Atoi(a[2])
+	bMajor, _ := strconv.Atoi(b[1])
+	bMinor, _ := strconv.Atoi(b[2])
+
+	return aMajor < bMajor || (aMajor == bMajor && aMinor < bMinor), true
+}
+
+func IsMariaDB(version string) bool {
+	return strings.Contains(strings.ToLower(version), "mariadb")
+}
+
+/*
+Reads the versions of the dump client, the mysql client and the servers, and warns about the
+mismatches that cause subtle failures. Versions that can't be read are reported as warnings too,
+so the run is never stopped by this check. target is nil for zip targets
+*/
+func ReportVersions(opts Options, source Connection, target *Connection) VersionReport {
+	report := VersionReport{Dumper: opts.Dumper}
+
+	warn := func(format string, args ...any) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	var err error
+
+	report.Client, err = GetClientVersion(source, opts.Dumper)
+
+	if err != nil {
+		warn("can't read the %s version: %s", opts.Dumper, err)
+	}
+
+	report.Source, err = GetServerVersion(source)
+
+	if err != nil {
+		warn("can't read the version of %s: %s", source.Name, err)
+	}
+
+	if target != nil {
+		report.Mysql, err = GetClientVersion(Connection{}, "mysql")
+
+		if err != nil {
+			warn("can't read the mysql version: %s", err)
+		}
+
+		report.Target, err = GetServerVersion(*target)
+
+		if err != nil {
+			warn("can't read the version of %s: %s", target.Name, err)
+		}
+	}
+
+	if report.Client != "" && report.Source != "" {
+		if IsMariaDB(report.Client) != IsMariaDB(report.Source) {
+			warn("%s %s and the %s server %s are from different vendors and may be incompatible", opts.Dumper, report.Client, source.Name, report.Source)
+		} else if older, ok := IsOlderVersion(report.Client, report.Source); ok && older {
+			warn("%s %s is older than the %s server %s", opts.Dumper, report.Client, source.Name, report.Source)
+		}
+	}
+
+	if report.Source != "" && report.Target != "" {
+		if older, ok := IsOlderVersion(report.Target, report.Source); ok && older && IsMariaDB(report.Target) == IsMariaDB(report.Source) {
+			warn("the %s server %s is older than the %s server %s, newer features and collations may fail to import", target.Name, report.Target, source.Name, report.Source)
+		}
+	}
+
+	return report
+}
+
+/* Prints the versions of a run and their warnings. Versions that couldn't be read show as ? */
+func PrintVersions(source Connection, target *Connection, report VersionReport) {
+	unknown := func(version string) string {
+		return lo.Ternary(version == "", "?", version)
+	}
+
+	line := fmt.Sprintf("Versions: %s %s", report.Dumper, unknown(report.Client))
+
+	if report.Mysql != "" || target != nil {
+		line += fmt.Sprintf(", mysql %s", unknown(report.Mysql))
+	}
+
+	line += fmt.Sprintf(", %s %s", source.Name, unknown(report.Source))
+
+	if target != nil {
+		line += fmt.Sprintf(", %s %s", target.Name, unknown(report.Target))
+	}
+
+	PRINTER.Printf("%s\n", line)
+
+	for _, warning := range report.Warnings {
+		PRINTER.Printf("  Warning: %s\n", warning)
+	}
+}
+
+/* Prints the client versions and the version of a server */
+func RunVersions(opts Options) error {
+	server, err := FindServer(opts.Source, "server")
+
+	if err != nil {
+		return err
+	}
+
+	report := ReportVersions(opts, server, nil)
+	report.Mysql, _ = GetClientVersion(Connection{}, "mysql")
+
+	if opts.Output == "json" {
+		return PrintJson(report)
+	}
+
+	if opts.Output == "csv" {
+		for _, warning := range report.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+
+		return PrintCsv([][]string{
+			{"program", "version"},
+			{report.Dumper, report.Client},
+			{"mysql", report.Mysql},
+			{server.Name, report.Source},
+		})
+	}
+
+	PrintVersions(server, nil, report)
+
+	return nil
+}
@@ -0,0 +1,746 @@
+package dbdump
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotateArchives(t *testing.T) {
+	files := []string{
+		"app_2024_01_01_00_00_00.zip",
+		"app_2024_01_02_00_00_00.zip",
+		"app_2024_01_01_00_00_00_nightly.zip",
+		"app_2024_01_02_00_00_00_nightly.zip",
+		"app_2024_01_01_00_00_00_pre-migration.zip",
+		"app_logs_2024_01_01_00_00_00.zip",
+		"app_2024_01_01_00_00_00.tar.gz",
+		"app_backup.zip",
+	}
+
+	tests := []struct {
+		name    string
+		label   string
+		current string
+		removed []string
+	}{
+		{
+			name:    "unlabeled run skips labeled archives",
+			current: "app_2024_01_03_00_00_00.zip",
+			removed: []string{"app_2024_01_01_00_00_00.zip", "app_2024_01_02_00_00_00.zip"},
+		},
+		{
+			name:    "labeled run only rotates its label",
+			label:   "nightly",
+			current: "app_2024_01_03_00_00_00_nightly.zip",
+			removed: []string{"app_2024_01_01_00_00_00_nightly.zip", "app_2024_01_02_00_00_00_nightly.zip"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			for i, file := range append(slices.Clone(files), test.current) {
+				path := filepath.Join(dir, file)
+
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				mtime := time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC)
+
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := Options{Db: "app", Format: "zip", Label: test.label, Rotate: 1, Time_format: "2006_01_02_15_04_05", Zip_output_folder: dir}
+
+			removed, err := RotateArchives(opts, filepath.Join(dir, test.current))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+
+			for _, path := range removed {
+				names = append(names, filepath.Base(path))
+			}
+
+			slices.Sort(names)
+
+			if !slices.Equal(names, test.removed) {
+				t.Errorf("removed %v, want %v", names, test.removed)
+			}
+		})
+	}
+}
+
+/* Canned behaviour of a program run by fakeRunner */
+type fakeCommand struct {
+	Output string
+	Stderr string
+	Err    error
+}
+
+/* Runs commands in goroutines instead of processes: each one reads its stdin, then writes its canned output */
+type fakeRunner struct {
+	Commands map[string]fakeCommand
+	Inputs   map[string]string
+	Started  []string
+	mutex    sync.Mutex
+	done     map[*exec.Cmd]chan error
+}
+
+func (f *fakeRunner) Start(cmd *exec.Cmd) error {
+	name := filepath.Base(cmd.Args[0])
+	command := f.Commands[name]
+	done := make(chan error, 1)
+
+	f.mutex.Lock()
+	f.Started = append(f.Started, name)
+	if f.done == nil {
+		f.done = map[*exec.Cmd]chan error{}
+	}
+	f.done[cmd] = done
+	f.mutex.Unlock()
+
+	go func() {
+		/* A failing import gives up without reading its input, like mysql losing its connection */
+		if cmd.Stdin != nil && command.Err == nil {
+			input, _ := io.ReadAll(cmd.Stdin)
+
+			f.mutex.Lock()
+			if f.Inputs == nil {
+				f.Inputs = map[string]string{}
+			}
+			f.Inputs[name] = string(input)
+			f.mutex.Unlock()
+		}
+
+		if cmd.Stdout != nil {
+			io.WriteString(cmd.Stdout, command.Output)
+		}
+
+		if cmd.Stderr != nil {
+			io.WriteString(cmd.Stderr, command.Stderr)
+		}
+
+		done <- command.Err
+	}()
+
+	return nil
+}
+
+func (f *fakeRunner) Wait(cmd *exec.Cmd) error {
+	f.mutex.Lock()
+	done := f.done[cmd]
+	f.mutex.Unlock()
+
+	return <-done
+}
+
+func TestPipeCommands(t *testing.T) {
+	dump := "CREATE TABLE `users` (`id` int);\nINSERT INTO `users` VALUES (1);\n"
+
+	tests := []struct {
+		name     string
+		commands map[string]fakeCommand
+		filter   bool
+		input    string
+		err      string
+	}{
+		{
+			name:     "dump is piped into the import",
+			commands: map[string]fakeCommand{"mysqldump": {Output: dump}},
+			input:    dump,
+		},
+		{
+			name:     "filter sits between dump and import",
+			commands: map[string]fakeCommand{"mysqldump": {Output: dump}, "filter": {Output: "filtered;\n"}},
+			filter:   true,
+			input:    "filtered;\n",
+		},
+		{
+			name:     "dump dying mid-stream fails the pipe",
+			commands: map[string]fakeCommand{"mysqldump": {Output: dump, Stderr: "mysqldump: Got error: 2013: Lost connection\n", Err: errors.New("exit status 2")}},
+			input:    dump,
+			err:      "mysqldump failed: exit status 2: mysqldump: Got error: 2013: Lost connection",
+		},
+		{
+			name:     "failed import stops the dump",
+			commands: map[string]fakeCommand{"mysqldump": {Output: dump}, "mysql": {Stderr: "ERROR 1045 (28000): Access denied\n", Err: errors.New("exit status 1")}},
+			err:      "mysql failed: exit status 1: ERROR 1045 (28000): Access denied",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{Commands: test.commands}
+			r := &Replicator{Runner: runner, Warnings: &ImportWarnings{Out: io.Discard}}
+
+			cmds := []*exec.Cmd{exec.Command("mysqldump")}
+
+			if test.filter {
+				cmds = append(cmds, exec.Command("filter"))
+			}
+
+			cmds = append(cmds, exec.Command("mysql"))
+
+			bytes, err := r.PipeCommands(Options{}, cmds...)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("error %v, want %s", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.err == "" && bytes != int64(len(dump)) {
+				t.Errorf("counted %d bytes, want %d", bytes, len(dump))
+			}
+
+			if runner.Inputs["mysql"] != test.input {
+				t.Errorf("import got %q, want %q", runner.Inputs["mysql"], test.input)
+			}
+		})
+	}
+}
+
+func TestReplicateTablesWithData(t *testing.T) {
+	dump := "CHANGE MASTER TO MASTER_LOG_FILE='binlog.000042', MASTER_LOG_POS=1337;\n-- Table structure for table `users`\n"
+
+	runner := &fakeRunner{Commands: map[string]fakeCommand{"mysqldump": {Output: dump}}}
+	r := &Replicator{Runner: runner, Warnings: &ImportWarnings{Out: io.Discard}}
+
+	source := Connection{Name: "source", Ip: "10.0.0.1"}
+	target := Connection{Name: "target", Ip: "10.0.0.2"}
+
+	bytes, position, err := r.ReplicateTablesWithData(Options{Dumper: "mysqldump"}, source, target, "app", "app", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes != int64(len(dump)) || position != "binlog.000042:1337" {
+		t.Errorf("got %d bytes at %s, want %d bytes at binlog.000042:1337", bytes, position, len(dump))
+	}
+
+	if !slices.Equal(runner.Started, []string{"mysqldump", "mysql"}) {
+		t.Errorf("started %v, want mysqldump and mysql", runner.Started)
+	}
+
+	if runner.Inputs["mysql"] != dump {
+		t.Errorf("import got %q, want %q", runner.Inputs["mysql"], dump)
+	}
+}
+
+func TestReplicateDatabaseSteps(t *testing.T) {
+	source := Connection{Name: "source", Ip: "10.0.0.1"}
+
+	/* Nothing listens on port 1, so the first query to the target fails right away */
+	unreachable := Connection{Name: "target", Ip: "127.0.0.1", Port: 1}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		target   Connection
+		targetDB string
+		step     ReplicationStep
+		err      string
+	}{
+		{
+			name:     "copy onto itself",
+			target:   source,
+			targetDB: "app",
+			step:     STEP_CHECK,
+			err:      "refusing to copy source:app onto itself",
+		},
+		{
+			name:     "mysqlpump can't rename",
+			opts:     Options{Dumper: "mysqlpump"},
+			target:   unreachable,
+			targetDB: "app_copy",
+			step:     STEP_CHECK,
+			err:      "mysqlpump qualifies tables",
+		},
+		{
+			name:     "unreachable target",
+			opts:     Options{Dumper: "mysqldump", On_exists: "drop"},
+			target:   unreachable,
+			targetDB: "app",
+			step:     STEP_CREATE,
+			err:      "connection refused",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			r := &Replicator{Runner: runner}
+
+			test.opts.Tmp_dir = t.TempDir()
+
+			_, err := r.ReplicateDatabase(test.opts, source, test.target, "app", test.targetDB)
+
+			replicationErr := ReplicationError{}
+
+			if !errors.As(err, &replicationErr) {
+				t.Fatalf("error %v, want a ReplicationError", err)
+			}
+
+			if replicationErr.Step != test.step || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %s step with %s", err, test.step, test.err)
+			}
+
+			/* Every step failing before the data pass leaves the programs alone */
+			if len(runner.Started) > 0 {
+				t.Errorf("started %v, want nothing", runner.Started)
+			}
+		})
+	}
+}
+
+/* Rows returned by fakeDatabase for the queries starting with a given prefix */
+type fakeResult struct {
+	Columns []string
+	Types   []string
+	Rows    [][]driver.Value
+}
+
+/* Answers queries with canned results instead of a server, to be opened with sql.OpenDB */
+type fakeDatabase struct {
+	Results map[string]fakeResult
+}
+
+func (f *fakeDatabase) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{database: f}, nil
+}
+
+func (f *fakeDatabase) Driver() driver.Driver {
+	return f
+}
+
+func (f *fakeDatabase) Open(name string) (driver.Conn, error) {
+	return &fakeConn{database: f}, nil
+}
+
+type fakeConn struct {
+	database *fakeDatabase
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{database: c.database, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeStmt struct {
+	database *fakeDatabase
+	query    string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	for prefix, result := range s.database.Results {
+		if strings.HasPrefix(s.query, prefix) {
+			return &fakeRows{result: result}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected query %s", s.query)
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.result.Columns
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.result.Types[index]
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.result.Rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.result.Rows[r.next])
+	r.next++
+
+	return nil
+}
+
+/* Makes OpenConnection return the fake database for connection until the test ends */
+func useFakeDatabase(t *testing.T, connection Connection, database *fakeDatabase) *sql.DB {
+	dsn, err := GetDSN(connection)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sql.OpenDB(database)
+	pool := POOL
+
+	POOL = &ConnectionPool{dbs: map[string]*sql.DB{dsn: db}}
+
+	t.Cleanup(func() {
+		POOL = pool
+		db.Close()
+	})
+
+	return db
+}
+
+func TestGetSelectedColumns(t *testing.T) {
+	source := Connection{Name: "source", Ip: "10.0.0.1", User: "dump"}
+
+	columns := fakeResult{
+		Columns: []string{"COLUMN_NAME", "EXTRA"},
+		Types:   []string{"VARCHAR", "VARCHAR"},
+		Rows: [][]driver.Value{
+			{[]byte("id"), []byte("auto_increment")},
+			{[]byte("first_name"), []byte("")},
+			{[]byte("created_at"), []byte("DEFAULT_GENERATED")},
+			{[]byte("full_name"), []byte("VIRTUAL GENERATED")},
+			{[]byte("total"), []byte("STORED GENERATED")},
+			{[]byte("secret"), []byte("")},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		excluded []string
+		columns  []string
+		err      string
+	}{
+		{
+			name:    "generated columns are left out",
+			columns: []string{"id", "first_name", "created_at", "secret"},
+		},
+		{
+			name:     "excluded columns are left out too",
+			excluded: []string{"secret"},
+			columns:  []string{"id", "first_name", "created_at"},
+		},
+		{
+			name:     "only generated columns left",
+			excluded: []string{"id", "first_name", "created_at", "secret"},
+			err:      "no columns left to copy",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeDatabase(t, source, &fakeDatabase{Results: map[string]fakeResult{"SELECT COLUMN_NAME, EXTRA": columns}})
+
+			selected, err := GetSelectedColumns(source, "app", "users", test.excluded)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("error %v, want %s", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(selected, test.columns) {
+				t.Errorf("selected %v, want %v", selected, test.columns)
+			}
+		})
+	}
+}
+
+func TestIsGeneratedColumn(t *testing.T) {
+	tests := map[string]bool{
+		"":                  false,
+		"auto_increment":    false,
+		"DEFAULT_GENERATED": false,
+		"VIRTUAL GENERATED": true,
+		"STORED GENERATED":  true,
+		"virtual generated": true,
+	}
+
+	for extra, generated := range tests {
+		if IsGeneratedColumn(extra) != generated {
+			t.Errorf("IsGeneratedColumn(%q) = %v, want %v", extra, !generated, generated)
+		}
+	}
+}
+
+func TestGetSelectQuery(t *testing.T) {
+	source := Connection{Name: "source", Ip: "10.0.0.1", User: "dump"}
+
+	useFakeDatabase(t, source, &fakeDatabase{Results: map[string]fakeResult{"SELECT COLUMN_NAME, EXTRA": {
+		Columns: []string{"COLUMN_NAME", "EXTRA"},
+		Types:   []string{"VARCHAR", "VARCHAR"},
+		Rows: [][]driver.Value{
+			{[]byte("id"), []byte("")},
+			{[]byte("total"), []byte("STORED GENERATED")},
+			{[]byte("secret"), []byte("")},
+		},
+	}}})
+
+	config := CONFIG
+	t.Cleanup(func() { CONFIG = config })
+
+	tests := []struct {
+		name   string
+		config Config
+		query  string
+	}{
+		{
+			name:  "generated columns are left out without excluded columns",
+			query: "SELECT `id`, `secret` FROM `orders`",
+		},
+		{
+			name:   "excluded columns and partitions",
+			config: Config{Exclude_columns: map[string][]string{"orders": {"secret"}}, Partitions: map[string][]string{"orders": {"p2024", "p2025"}}},
+			query:  "SELECT `id` FROM `orders` PARTITION (`p2024`, `p2025`)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			CONFIG = test.config
+
+			query, err := GetSelectQuery(source, "app", "orders")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if query != test.query {
+				t.Errorf("query %s, want %s", query, test.query)
+			}
+		})
+	}
+}
+
+func TestWriteInsertStatements(t *testing.T) {
+	db := sql.OpenDB(&fakeDatabase{Results: map[string]fakeResult{"SELECT `id`, `name`, `avatar` FROM `users`": {
+		Columns: []string{"id", "name", "avatar"},
+		Types:   []string{"INT", "VARCHAR", "BLOB"},
+		Rows: [][]driver.Value{
+			{[]byte("1"), []byte("O'Brien"), []byte{0xff, 0x00}},
+			{[]byte("2"), nil, []byte{}},
+		},
+	}}})
+
+	defer db.Close()
+
+	var out bytes.Buffer
+
+	err := WriteInsertStatements(&out, db, "users", "SELECT `id`, `name`, `avatar` FROM `users`")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "INSERT INTO `users` (`id`, `name`, `avatar`) VALUES (1, 'O\\'Brien', 0xff00),\n(2, NULL, '');\n"
+
+	if out.String() != expected {
+		t.Errorf("wrote %q, want %q", out.String(), expected)
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection Connection
+		port       int
+		address    string
+	}{
+		{name: "default port", connection: Connection{Ip: "10.0.0.1"}, port: 3306, address: "10.0.0.1:3306"},
+		{name: "configured port", connection: Connection{Ip: "10.0.0.1", Port: 3307}, port: 3307, address: "10.0.0.1:3307"},
+		{name: "hostname", connection: Connection{Ip: "db.internal"}, port: 3306, address: "db.internal:3306"},
+		{name: "ipv6 is bracketed", connection: Connection{Ip: "::1", Port: 3307}, port: 3307, address: "[::1]:3307"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if port := GetPort(test.connection); port != test.port {
+				t.Errorf("port %d, want %d", port, test.port)
+			}
+
+			if address := GetAddress(test.connection); address != test.address {
+				t.Errorf("address %s, want %s", address, test.address)
+			}
+		})
+	}
+}
+
+func TestGetDSN(t *testing.T) {
+	defaultsFile := filepath.Join(t.TempDir(), "client.cnf")
+
+	err := os.WriteFile(defaultsFile, []byte("[mysqld]\nuser=mysql\n\n[client]\nuser = backup\npassword = \"s3cret\"\n"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		connection Connection
+		dsn        string
+	}{
+		{
+			name:       "default port",
+			connection: Connection{Ip: "10.0.0.1", User: "root", Password: "pass"},
+			dsn:        "root:pass@tcp(10.0.0.1:3306)/",
+		},
+		{
+			name:       "configured port",
+			connection: Connection{Ip: "10.0.0.1", Port: 3307, User: "root", Password: "pass"},
+			dsn:        "root:pass@tcp(10.0.0.1:3307)/",
+		},
+		{
+			name:       "address family",
+			connection: Connection{Ip: "db.internal", User: "root", Password: "pass", Address_family: "ipv6"},
+			dsn:        "root:pass@tcp6(db.internal:3306)/",
+		},
+		{
+			name:       "credentials of the defaults file",
+			connection: Connection{Ip: "10.0.0.1", User: "root", Password: "pass", Defaults_file: defaultsFile},
+			dsn:        "backup:s3cret@tcp(10.0.0.1:3306)/",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dsn, err := GetDSN(test.connection)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dsn != test.dsn {
+				t.Errorf("dsn %s, want %s", dsn, test.dsn)
+			}
+		})
+	}
+
+	_, err = GetDSN(Connection{Ip: "10.0.0.1", Defaults_file: filepath.Join(t.TempDir(), "missing.cnf")})
+
+	if err == nil {
+		t.Error("missing defaults file, want an error")
+	}
+}
+
+func TestGetConnectError(t *testing.T) {
+	err := GetConnectError(Connection{Ip: "10.0.0.1", Port: 3307}, errors.New("connection refused"))
+
+	if err.Error() != "connect to 10.0.0.1:3307 failed: connection refused" {
+		t.Errorf("error %s", err)
+	}
+}
+
+func TestPrintConfigKeepsPasswords(t *testing.T) {
+	config := CONFIG
+	t.Cleanup(func() { CONFIG = config })
+
+	var out bytes.Buffer
+
+	err := PrintConfig(Config{Servers: []Connection{{Name: "prod", Ip: "10.0.0.1", User: "root", Password: "s3cret"}}}, Options{}, &out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"Password": "********"`) || strings.Contains(out.String(), "s3cret") {
+		t.Errorf("printed %s, want the password redacted", out.String())
+	}
+
+	if CONFIG.Servers[0].Password != "s3cret" {
+		t.Errorf("CONFIG password %s, want s3cret", CONFIG.Servers[0].Password)
+	}
+}
+
+func TestGetViewsDumpCommandCharset(t *testing.T) {
+	source := Connection{Name: "source", Ip: "10.0.0.1", Charset: "utf8mb4"}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		charset string
+	}{
+		{name: "connection charset", charset: "--default-character-set=utf8mb4"},
+		{name: "source charset wins, like the tables", opts: Options{Source_charset: "latin1"}, charset: "--default-character-set=latin1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := GetViewsDumpCommand(test.opts, source, "app", []string{"active_users"})
+
+			if !slices.Contains(cmd.Args, test.charset) {
+				t.Errorf("args %v, want %s", cmd.Args, test.charset)
+			}
+		})
+	}
+}
+
+func TestValidateConfigCharset(t *testing.T) {
+	tests := []struct {
+		name    string
+		charset string
+		valid   bool
+	}{
+		{name: "unset", valid: true},
+		{name: "plain name", charset: "utf8mb4", valid: true},
+		{name: "statement", charset: "latin1; DROP DATABASE app", valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateConfig(Config{Servers: []Connection{{Name: "prod", Ip: "10.0.0.1", Charset: test.charset}}})
+
+			if (err == nil) != test.valid {
+				t.Errorf("error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package dbdump
+
+import "errors"
+
+func GetFreeSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package dbdump
+
+import "syscall"
+
+/* Returns the bytes available to this user on the filesystem of path */
+func GetFreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(path, &stat)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package dbdump
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+/* Returns the bytes available to this user on the volume of path */
+func GetFreeSpace(path string) (int64, error) {
+	pointer, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var free int64
+
+	result, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pointer)), uintptr(unsafe.Pointer(&free)), 0, 0)
+
+	if result == 0 {
+		return 0, err
+	}
+
+	return free, nil
+}
@@ -1,9 +1,10 @@
 module test-dump
 
-go 1.22.0
+go 1.25
 
 require (
 	github.com/go-sql-driver/mysql v1.8.1
+	github.com/klauspost/compress v1.20.1
 	github.com/samber/lo v1.39.0
 )
 
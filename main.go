@@ -1,533 +1,1035 @@
 package main
 
 import (
-	"archive/zip"
-	"compress/flate"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/samber/lo"
+	"test-dump/dbdump"
 )
 
-var CONFIG Config
-
-var SOURCE_ARG string
-var TARGET_ARG string
-var DB_ARG string
-var USE_EMPTY_TABLES_ARG bool = true
-var ZIPFILENAME_ARG string
-
-type Config struct {
-	Servers              []Connection
-	Empty_tables         []string
-	Transactions         [][]string
-	Post_process_queries []string
+func HelpDump() {
+	fmt.Println("Usage: dump [COMMAND] [POSITIONAL ARGS] [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Commands: bulk, copy, copy-routines, migrate-schema, restore, zip-all, tables, estimate, verify, versions")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show help for the command")
+	fmt.Println("  --host-override NAME=HOST:PORT  Connect to HOST:PORT instead of the configured address of server NAME (repeatable)")
+	fmt.Println("  --config FILE  Config file, default config.json, or - for stdin. Repeat it to merge later files into earlier ones (see README)")
+	fmt.Println("  --config-format json  Format of the config files (default json, the only one supported)")
+	fmt.Println("  --print-config  Print the config and options in effect as json, passwords redacted, and exit")
+	fmt.Println("")
+	fmt.Println("Exit codes:")
+	fmt.Println("  0        Success")
+	fmt.Println("  1        Runtime error, e.g. a failed connection, dump or import. Retrying may help")
+	fmt.Println("  2        Config or usage error, e.g. an unknown server or an invalid flag")
+	fmt.Println("  3        Partial success: bulk or zip-all only copied some of the databases")
 }
 
-type Connection struct {
-	Name     string
-	Ip       string
-	User     string
-	Password string
+func HelpCopy() {
+	fmt.Println("Usage: copy SOURCE TARGET DB [FLAGS]")
+	fmt.Println("       copy SOURCE zip DB [FLAGS]")
+	fmt.Println("       copy SOURCE file:PATH DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SOURCE   Name of the source database")
+	fmt.Println("  TARGET   Name of the target database, zip, or file:PATH for a plain sql file (relative to -o)")
+	fmt.Println("  DB       Name of the database to dump")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  -i       Performs full dump ignoring post-cleanup queries and empty-tables configuration")
+	fmt.Println("  -f       Filename for the generated zip")
+	fmt.Println("  -o       Output folder for the generated zip")
+	fmt.Println("  --tmp-dir PATH  Folder for the intermediate sql file (default the system temp folder)")
+	fmt.Println("  --keep-sql  Don't remove the intermediate sql file")
+	fmt.Println("  --rotate N  Keep only the N newest archives of the database in the output folder")
+	fmt.Println("  --skip-space-check  Don't check the free disk space before dumping")
+	fmt.Println("  --utc  Use UTC instead of local time in filenames and metadata")
+	fmt.Println("  --time-format LAYOUT  Go time layout of the timestamps in filenames (default 2006_01_02_15_04_05)")
+	fmt.Println("  --format zip|targz|zstd  Archive format when the target is zip (default zip)")
+	fmt.Println("  --zstd-level N  Zstandard compression level from 1 to 22 (default 3)")
+	fmt.Println("  --archive-comment TEXT  Comment stored in zip and targz archives, with {db}, {source}, {date} and {label} tokens")
+	fmt.Println("  --mtime TIME  Modification time (RFC3339) of the archive entries")
+	fmt.Println("  --mtime-epoch SECONDS  Modification time of the archive entries as Unix time")
+	fmt.Println("  --force  Overwrite the target even if its schema version differs")
+	fmt.Println("  --insert-ignore  Dump rows as INSERT IGNORE, skipping duplicated keys")
+	fmt.Println("  --replace  Dump rows as REPLACE, overwriting duplicated keys")
+	fmt.Println("  --validate-queries  EXPLAIN or parse the post-process queries instead of running them")
+	fmt.Println("  --post-dry-run  Count the rows each post-process query would affect instead of running them")
+	fmt.Println("  --post-tags TAG1,TAG2  Only run the post-process queries with one of these Tags (repeatable)")
+	fmt.Println("  --all-post  With --post-tags, also run the post-process queries without Tags")
+	fmt.Println("  --validate-stream  Buffer the whole dump in a temp file and check it isn't truncated before loading it")
+	fmt.Println("  --strict  Fail on import warnings or on config tables missing from the source")
+	fmt.Println("  --check-import  Count the statements of the import and check its tables are on the target (see README)")
+	fmt.Println("  --progress  Show the table being dumped, on a terminal")
+	fmt.Println("  --retry-db N  Start a database over up to N times after a transient network error")
+	fmt.Println("  --health-ttl DURATION  Don't ping a source host again if it answered within DURATION (e.g. 30s)")
+	fmt.Println("  --filter CMD  Pipe the dump through CMD (run by the shell) before importing it")
+	fmt.Println("  --rewrite-definer USER[@HOST]  Rewrite the DEFINER of views, triggers and routines, empty strips it")
+	fmt.Println("  --dump-master-data  Record the source binlog coordinates in the dump and print them")
+	fmt.Println("  --flush-logs  Rotate the source binary logs at the start of the dump")
+	fmt.Println("  --no-tz-utc  Dump TIMESTAMP values in the source time zone instead of UTC (see README)")
+	fmt.Println("  --include-tablespaces  Keep the tablespace definitions in the schema pass, needs the PROCESS privilege")
+	fmt.Println("  --exact  Dump the rows byte for byte, without charset or time zone conversion (see README)")
+	fmt.Println("  --lock-mode transaction|tables|none  How the source is locked while dumping (default transaction)")
+	fmt.Println("  --consistent  Block every write to the source with a global read lock while it's dumped (see README)")
+	fmt.Println("  --gtid-purged OFF|ON|AUTO|COMMENTED  Value of mysqldump --set-gtid-purged (default OFF)")
+	fmt.Println("  --no-views  Don't dump views")
+	fmt.Println("  --views-last  Create views in a final pass, after all the tables")
+	fmt.Println("  --on-exists drop|fail|truncate  What to do when the target database exists (default drop)")
+	fmt.Println("  --import-sql-mode MODE  sql_mode of the import session, empty disables strict mode")
+	fmt.Println("  --import-fast  Import in a single transaction without unique and foreign key checks (see README)")
+	fmt.Println("  --disable-fk-checks=false  Keep foreign key checks on while importing (disabled by default)")
+	fmt.Println("  --skip-schema-pass  Keep the empty tables of an existing target instead of recreating them")
+	fmt.Println("  --truncate-empty  Truncate the empty tables kept by --skip-schema-pass")
+	fmt.Println("  --max-table-size SIZE  Only copy the schema of tables bigger than SIZE, e.g. 500MB or 2GB")
+	fmt.Println("  --data-tables T1,T2  Only copy the data of these tables, and the schema of the rest (repeatable)")
+	fmt.Println("  --dumper mysqldump|mysqlpump  Program used to dump the source (default mysqldump)")
+	fmt.Println("  --threads N  Parallel threads, only with mysqlpump or --fast-load")
+	fmt.Println("  --source-charset CHARSET  Character set used by mysqldump to read the source")
+	fmt.Println("  --target-charset CHARSET  Default character set of the created target database")
+	fmt.Println("  --target-collation COLLATION  Default collation of the created target database")
+	fmt.Println("  --only-changed  Only reload the tables whose checksum differs from the target")
+	fmt.Println("  --fast-load  Dump with --tab and load the tables in parallel with LOAD DATA (see README)")
+	fmt.Println("  --merge  Only drop and reload the --tables, keeping the rest of the target database")
+	fmt.Println("  --tables T1,T2  Tables reloaded by --merge (repeatable)")
+	fmt.Println("  --also-zip  Also archive the stream imported into the target, with the zip flags")
+	fmt.Println("  --resume-from TABLE  Resume a failed copy from TABLE, keeping the tables completed before it")
+	fmt.Println("  --explain  List what would be done with every table and the post-process queries, without dumping")
+	fmt.Println("  --only-create-db  Only create the empty target database, with the charset and collation of the source, and copy nothing")
+	fmt.Println("  --quiet  Only print the final summary line")
+	fmt.Println("  --json  Print the final summary as json, and nothing else")
+	fmt.Println("  --webhook URL  POST a json report of the run to URL when it ends")
+	fmt.Println("  --webhook-on always|failure  When to call --webhook (default always)")
+	fmt.Println("  --label TEXT  Label of the run, added to the filenames, log lines, summary and webhook report")
 }
 
-func GetDumpCommand(connection Connection, dbName string, withData bool) *exec.Cmd {
-	args := []string{
-		fmt.Sprintf("--host=%s", connection.Ip),
-		fmt.Sprintf("--user=%s", connection.User),
-		"--skip-lock-tables",
-		"--max-allowed-packet=2GB",
-		"--single-transaction",
-		"--set-gtid-purged=OFF",
-	}
-
-	if connection.Password != "" {
-		args = append(args, fmt.Sprintf("--password=%s", connection.Password))
-	}
+func HelpCopyRoutines() {
+	fmt.Println("Usage: copy-routines SOURCE TARGET DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SOURCE   Name of the source database")
+	fmt.Println("  TARGET   Name of the target database")
+	fmt.Println("  DB       Name of the database whose routines are copied")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  --rewrite-definer USER[@HOST]  Rewrite the DEFINER of the routines, empty strips it")
+}
 
-	args = append(args, dbName)
+func HelpMigrateSchema() {
+	fmt.Println("Usage: migrate-schema SOURCE TARGET DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SOURCE   Name of the source database")
+	fmt.Println("  TARGET   Name of the target database")
+	fmt.Println("  DB       Name of the database whose schema is migrated")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  --dry-run  Print the statements instead of applying them")
+}
 
-	if USE_EMPTY_TABLES_ARG && len(CONFIG.Empty_tables) > 0 {
-		if withData {
-			tables := lo.Map(CONFIG.Empty_tables, func(table string, index int) string {
-				return fmt.Sprintf("--ignore-table=%s.%s", dbName, table)
-			})
+func HelpRestore() {
+	fmt.Println("Usage: restore FILE TARGET DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  FILE     Archive (.zip, .tar.gz or .sql.zst) or sql file to import")
+	fmt.Println("  TARGET   Name of the target database")
+	fmt.Println("  DB       Name of the database to create")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  --on-exists drop|fail|truncate  What to do when the target database exists (default drop)")
+	fmt.Println("  --import-sql-mode MODE  sql_mode of the import session, empty disables strict mode")
+	fmt.Println("  --import-fast  Import in a single transaction without unique and foreign key checks (see README)")
+	fmt.Println("  --disable-fk-checks=false  Keep foreign key checks on while importing (disabled by default)")
+	fmt.Println("  --rewrite-definer USER[@HOST]  Rewrite the DEFINER of views, routines and triggers, empty strips it")
+}
 
-			args = append(args, tables...)
-		} else {
-			args = append(args, "--no-data", "--no-create-db", "--no-tablespaces", "--tables")
-			args = append(args, CONFIG.Empty_tables...)
-		}
-	}
+func HelpZipAll() {
+	fmt.Println("Usage: zip-all SERVER --out DIR [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SERVER   Name of the server whose databases are zipped")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  -o, --out DIR  Output folder for the archives and the manifest, created if missing")
+	fmt.Println("  -j N     Number of databases zipped in parallel (default 1)")
+	fmt.Println("  --exclude-db NAME  Skip databases matching NAME (glob, repeatable)")
+	fmt.Println("  --tmp-dir PATH  Folder for the intermediate sql files (default the system temp folder)")
+	fmt.Println("  --rotate N  Keep only the N newest archives of each database in the output folder")
+	fmt.Println("  --skip-space-check  Don't check the free disk space before dumping")
+	fmt.Println("  --utc  Use UTC instead of local time in filenames and metadata")
+	fmt.Println("  --time-format LAYOUT  Go time layout of the timestamps in filenames (default 2006_01_02_15_04_05)")
+	fmt.Println("  --format zip|targz|zstd  Archive format (default zip)")
+	fmt.Println("  --zstd-level N  Zstandard compression level from 1 to 22 (default 3)")
+	fmt.Println("  --archive-comment TEXT  Comment stored in zip and targz archives, with {db}, {source}, {date} and {label} tokens")
+	fmt.Println("  --lock-mode transaction|tables|none  How the source is locked while dumping (default transaction)")
+	fmt.Println("  --consistent  Block every write to the source with a global read lock while it's dumped (see README)")
+	fmt.Println("  --label TEXT  Label of the run, added to the filenames, log lines and summary")
+}
 
-	return exec.Command("mysqldump", args...)
+func HelpBulk() {
+	fmt.Println("Usage: bulk SOURCE TARGET [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SOURCE   Name of the source database")
+	fmt.Println("  TARGET   Name of the target database")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  -i       Performs full dump ignoring post-cleanup queries and empty-tables configuration")
+	fmt.Println("  --force  Overwrite targets even if their schema version differs")
+	fmt.Println("  --insert-ignore  Dump rows as INSERT IGNORE, skipping duplicated keys")
+	fmt.Println("  --replace  Dump rows as REPLACE, overwriting duplicated keys")
+	fmt.Println("  --validate-queries  EXPLAIN or parse the post-process queries instead of running them")
+	fmt.Println("  --post-dry-run  Count the rows each post-process query would affect instead of running them")
+	fmt.Println("  --post-tags TAG1,TAG2  Only run the post-process queries with one of these Tags (repeatable)")
+	fmt.Println("  --all-post  With --post-tags, also run the post-process queries without Tags")
+	fmt.Println("  --validate-stream  Buffer the whole dump in a temp file and check it isn't truncated before loading it")
+	fmt.Println("  --strict  Fail on import warnings or on config tables missing from the source")
+	fmt.Println("  --check-import  Count the statements of the import and check its tables are on the target (see README)")
+	fmt.Println("  --progress  Show the table being dumped, on a terminal")
+	fmt.Println("  --retry-db N  Start a database over up to N times after a transient network error")
+	fmt.Println("  --health-ttl DURATION  Don't ping a source host again if it answered within DURATION (e.g. 30s)")
+	fmt.Println("  --filter CMD  Pipe the dump through CMD (run by the shell) before importing it")
+	fmt.Println("  --rewrite-definer USER[@HOST]  Rewrite the DEFINER of views, triggers and routines, empty strips it")
+	fmt.Println("  --dump-master-data  Record the source binlog coordinates in the dump and print them")
+	fmt.Println("  --flush-logs  Rotate the source binary logs at the start of the dump")
+	fmt.Println("  --no-tz-utc  Dump TIMESTAMP values in the source time zone instead of UTC (see README)")
+	fmt.Println("  --include-tablespaces  Keep the tablespace definitions in the schema pass, needs the PROCESS privilege")
+	fmt.Println("  --exact  Dump the rows byte for byte, without charset or time zone conversion (see README)")
+	fmt.Println("  --lock-mode transaction|tables|none  How the source is locked while dumping (default transaction)")
+	fmt.Println("  --consistent  Block every write to the source with a global read lock while it's dumped (see README)")
+	fmt.Println("  --gtid-purged OFF|ON|AUTO|COMMENTED  Value of mysqldump --set-gtid-purged (default OFF)")
+	fmt.Println("  --no-views  Don't dump views")
+	fmt.Println("  --views-last  Create views in a final pass, after all the tables")
+	fmt.Println("  --on-exists drop|fail|truncate  What to do when a target database exists (default drop)")
+	fmt.Println("  --import-sql-mode MODE  sql_mode of the import session, empty disables strict mode")
+	fmt.Println("  --import-fast  Import in a single transaction without unique and foreign key checks (see README)")
+	fmt.Println("  --disable-fk-checks=false  Keep foreign key checks on while importing (disabled by default)")
+	fmt.Println("  --skip-schema-pass  Keep the empty tables of an existing target instead of recreating them")
+	fmt.Println("  --truncate-empty  Truncate the empty tables kept by --skip-schema-pass")
+	fmt.Println("  --max-table-size SIZE  Only copy the schema of tables bigger than SIZE, e.g. 500MB or 2GB")
+	fmt.Println("  --data-tables T1,T2  Only copy the data of these tables, and the schema of the rest (repeatable)")
+	fmt.Println("  --dumper mysqldump|mysqlpump  Program used to dump the source (default mysqldump)")
+	fmt.Println("  --threads N  Parallel threads, only with mysqlpump")
+	fmt.Println("  --max-runtime DURATION  Don't start more databases once the run would exceed DURATION (e.g. 2h)")
+	fmt.Println("  --exclude-db NAME  Skip source databases matching NAME (glob, repeatable)")
+	fmt.Println("  --only DB1,DB2  Only run the Transactions whose source or target is one of these (repeatable)")
+	fmt.Println("  --include-system  Let % patterns of Transactions match the system databases")
+	fmt.Println("  --skip-missing  Skip the Transactions whose source database doesn't exist instead of failing")
+	fmt.Println("  --allow-empty  Succeed without copying anything when there are no databases to copy")
+	fmt.Println("  --source-charset CHARSET  Character set used by mysqldump to read the source")
+	fmt.Println("  --target-charset CHARSET  Default character set of the created target database")
+	fmt.Println("  --target-collation COLLATION  Default collation of the created target database")
+	fmt.Println("  --webhook URL  POST a json report of the run to URL when it ends")
+	fmt.Println("  --webhook-on always|failure  When to call --webhook (default always)")
+	fmt.Println("  --label TEXT  Label of the run, added to the filenames, log lines, summary and webhook report")
 }
 
-func GetMysqlCommand(connection Connection, dbName string) *exec.Cmd {
-	args := []string{
-		fmt.Sprintf("--host=%s", connection.Ip),
-		fmt.Sprintf("--user=%s", connection.User),
-		fmt.Sprintf("--database=%s", dbName),
-		"--max-allowed-packet=2GB",
-		"--ssl-mode=DISABLED",
-	}
+func HelpTables() {
+	fmt.Println("Usage: tables SERVER DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SERVER   Name of the server")
+	fmt.Println("  DB       Name of the database")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  --top N  Show only the N biggest tables")
+	fmt.Println("  --output json|table|csv  Format of the result (default table)")
+}
 
-	if connection.Password != "" {
-		args = append(args, fmt.Sprintf("--password=%s", connection.Password))
-	}
+func HelpEstimate() {
+	fmt.Println("Usage: estimate SERVER DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SERVER   Name of the server")
+	fmt.Println("  DB       Name of the database")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  -i       Include the data of empty-tables in the estimate")
+}
 
-	args = append(args, dbName)
+func HelpVerify() {
+	fmt.Println("Usage: verify SOURCE TARGET DB [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SOURCE   Name of the source database")
+	fmt.Println("  TARGET   Name of the target database")
+	fmt.Println("  DB       Name of the database to compare")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  -i       Also compare the tables in empty-tables configuration")
+}
 
-	return exec.Command("mysql", args...)
+func HelpVersions() {
+	fmt.Println("Usage: versions SERVER [FLAGS]")
+	fmt.Println("")
+	fmt.Println("Arguments:")
+	fmt.Println("  SERVER   Name of the server")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("  -h       Show this help")
+	fmt.Println("  --dumper mysqldump|mysqlpump  Program whose version is read (default mysqldump)")
+	fmt.Println("  --output json|table|csv  Format of the result (default table)")
 }
 
-func PipeCommands(c1 *exec.Cmd, c2 *exec.Cmd) error {
-	pr, pw := io.Pipe()
+/* Flag value collecting every occurrence of a repeatable flag */
+type StringList []string
 
-	c1.Stdout = pw
-	c2.Stdin = pr
-	c2.Stdout = os.Stdout
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	err := c1.Start()
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	if err != nil {
-		return err
-	}
+/* Flags shared by the commands that copy databases */
+func AddReplicationFlags(fs *flag.FlagSet, opts *dbdump.Options) {
+	fs.StringVar(&opts.Source_charset, "source-charset", "", "")
+	fs.Func("import-sql-mode", "", func(value string) error {
+		opts.Import_sql_mode = &value
+		return nil
+	})
+	fs.StringVar(&opts.On_exists, "on-exists", opts.On_exists, "")
+	fs.BoolVar(&opts.No_views, "no-views", false, "")
+	fs.BoolVar(&opts.Views_last, "views-last", false, "")
+	fs.BoolVar(&opts.Dump_master_data, "dump-master-data", false, "")
+	fs.BoolVar(&opts.Flush_logs, "flush-logs", false, "")
+	fs.BoolVar(&opts.No_tz_utc, "no-tz-utc", false, "")
+	fs.BoolVar(&opts.Tablespaces, "include-tablespaces", false, "")
+	fs.BoolVar(&opts.Exact, "exact", false, "")
+	fs.StringVar(&opts.Lock_mode, "lock-mode", opts.Lock_mode, "")
+	fs.StringVar(&opts.Gtid_purged, "gtid-purged", opts.Gtid_purged, "")
+	fs.BoolVar(&opts.Force, "force", false, "")
+	fs.BoolVar(&opts.Insert_ignore, "insert-ignore", false, "")
+	fs.BoolVar(&opts.Replace, "replace", false, "")
+	fs.BoolVar(&opts.Validate_queries, "validate-queries", false, "")
+	fs.BoolVar(&opts.Post_dry_run, "post-dry-run", false, "")
+	fs.BoolVar(&opts.Strict, "strict", false, "")
+	fs.BoolVar(&opts.Check_import, "check-import", false, "")
+	fs.BoolVar(&opts.Progress, "progress", false, "")
+	fs.IntVar(&opts.Retry_db, "retry-db", 0, "")
+	fs.StringVar(&opts.Filter, "filter", "", "")
+	fs.Func("rewrite-definer", "", func(value string) error {
+		opts.Rewrite_definer = &value
+		return nil
+	})
+	fs.StringVar(&opts.Dumper, "dumper", opts.Dumper, "")
+	fs.IntVar(&opts.Threads, "threads", 0, "")
+	fs.StringVar(&opts.Target_charset, "target-charset", "", "")
+	fs.StringVar(&opts.Target_collation, "target-collation", "", "")
+	fs.BoolVar(&opts.Import_fast, "import-fast", false, "")
+	fs.BoolVar(&opts.Disable_fk_checks, "disable-fk-checks", true, "")
+	fs.BoolVar(&opts.Skip_schema_pass, "skip-schema-pass", false, "")
+	fs.BoolVar(&opts.Truncate_empty, "truncate-empty", false, "")
+	fs.Func("max-table-size", "", func(value string) error {
+		size, err := dbdump.ParseBytes(value)
 
-	err = c2.Start()
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
-	}
+		opts.Max_table_size = size
+		return nil
+	})
+	fs.DurationVar(&opts.Health_ttl, "health-ttl", 0, "")
+	fs.BoolVar(&opts.Consistent, "consistent", false, "")
+	fs.Func("data-tables", "", func(value string) error {
+		opts.Data_tables = append(opts.Data_tables, strings.Split(value, ",")...)
+		return nil
+	})
+	fs.Func("post-tags", "", func(value string) error {
+		opts.Post_tags = append(opts.Post_tags, strings.Split(value, ",")...)
+		return nil
+	})
+	fs.BoolVar(&opts.All_post, "all-post", false, "")
+	fs.BoolVar(&opts.Validate_stream, "validate-stream", false, "")
+	fs.StringVar(&opts.Webhook, "webhook", "", "")
+	fs.StringVar(&opts.Webhook_on, "webhook-on", opts.Webhook_on, "")
+	fs.StringVar(&opts.Label, "label", "", "")
+}
 
-	go func() {
-		defer pw.Close()
+/* Flags of the zip target of the copy command */
+func AddZipFlags(fs *flag.FlagSet, opts *dbdump.Options) {
+	fs.StringVar(&opts.Zip_filename, "f", "", "")
+	fs.StringVar(&opts.Zip_filename, "file", "", "")
+	fs.StringVar(&opts.Zip_output_folder, "o", "", "")
+	fs.StringVar(&opts.Zip_output_folder, "output", "", "")
+	fs.StringVar(&opts.Format, "format", opts.Format, "")
+	fs.IntVar(&opts.Zstd_level, "zstd-level", 0, "")
+	fs.StringVar(&opts.Tmp_dir, "tmp-dir", "", "")
+	fs.BoolVar(&opts.Keep_sql, "keep-sql", false, "")
+	fs.IntVar(&opts.Rotate, "rotate", 0, "")
+	fs.BoolVar(&opts.Skip_space_check, "skip-space-check", false, "")
+	fs.BoolVar(&opts.Utc, "utc", false, "")
+	fs.StringVar(&opts.Time_format, "time-format", "", "")
+	fs.StringVar(&opts.Archive_comment, "archive-comment", "", "")
+	fs.Func("mtime", "", func(value string) error {
+		mtime, err := time.Parse(time.RFC3339, value)
 
-		c1.Wait()
-	}()
+		if err != nil {
+			return fmt.Errorf("expected RFC3339 time")
+		}
 
-	err = c2.Wait()
+		opts.Mtime = mtime
+		return nil
+	})
+	fs.Func("mtime-epoch", "", func(value string) error {
+		seconds, err := strconv.ParseInt(value, 10, 64)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return fmt.Errorf("expected Unix time in seconds")
+		}
 
-	return nil
+		opts.Mtime = time.Unix(seconds, 0).UTC()
+		return nil
+	})
 }
 
-func CreateTargetDatabase(connection Connection, dbName string) error {
-	sql, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:3306)/", connection.User, connection.Password, connection.Ip))
+/* Returns the flag set of a command and the names of its positional arguments */
+func NewFlagSet(command string, opts *dbdump.Options) (*flag.FlagSet, []string) {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
 
-	if err != nil {
-		return err
+	disableEmptyTables := func(string) error {
+		opts.Use_empty_tables = false
+		return nil
 	}
 
-	_, err = sql.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
-
-	if err != nil {
-		return err
+	fs.Var((*StringList)(&opts.Host_overrides), "host-override", "")
+	fs.BoolVar(&opts.Print_config, "print-config", false, "")
+	fs.Var((*StringList)(&opts.Config_files), "config", "")
+	fs.StringVar(&opts.Config_format, "config-format", opts.Config_format, "")
+
+	switch command {
+	case "copy":
+		fs.BoolFunc("i", "", disableEmptyTables)
+		AddReplicationFlags(fs, opts)
+		AddZipFlags(fs, opts)
+		fs.BoolVar(&opts.Quiet, "quiet", false, "")
+		fs.BoolVar(&opts.Json, "json", false, "")
+		fs.BoolVar(&opts.Only_changed, "only-changed", false, "")
+		fs.BoolVar(&opts.Fast_load, "fast-load", false, "")
+		fs.BoolVar(&opts.Merge, "merge", false, "")
+		fs.BoolVar(&opts.Also_zip, "also-zip", false, "")
+		fs.StringVar(&opts.Resume_from, "resume-from", "", "")
+		fs.BoolVar(&opts.Explain, "explain", false, "")
+		fs.BoolVar(&opts.Only_create_db, "only-create-db", false, "")
+		fs.Func("tables", "", func(value string) error {
+			opts.Tables = append(opts.Tables, strings.Split(value, ",")...)
+			return nil
+		})
+		return fs, []string{"SOURCE", "TARGET", "DB"}
+	case "bulk":
+		fs.BoolFunc("i", "", disableEmptyTables)
+		AddReplicationFlags(fs, opts)
+		fs.Var((*StringList)(&opts.Exclude_db), "exclude-db", "")
+		fs.Func("only", "", func(value string) error {
+			opts.Only = append(opts.Only, strings.Split(value, ",")...)
+			return nil
+		})
+		fs.DurationVar(&opts.Max_runtime, "max-runtime", 0, "")
+		fs.BoolVar(&opts.Include_system, "include-system", false, "")
+		fs.BoolVar(&opts.Skip_missing, "skip-missing", false, "")
+		fs.BoolVar(&opts.Allow_empty, "allow-empty", false, "")
+		return fs, []string{"SOURCE", "TARGET"}
+	case "copy-routines":
+		fs.Func("rewrite-definer", "", func(value string) error {
+			opts.Rewrite_definer = &value
+			return nil
+		})
+		return fs, []string{"SOURCE", "TARGET", "DB"}
+	case "migrate-schema":
+		fs.BoolVar(&opts.Dry_run, "dry-run", false, "")
+		return fs, []string{"SOURCE", "TARGET", "DB"}
+	case "restore":
+		fs.StringVar(&opts.On_exists, "on-exists", opts.On_exists, "")
+		fs.Func("import-sql-mode", "", func(value string) error {
+			opts.Import_sql_mode = &value
+			return nil
+		})
+		fs.BoolVar(&opts.Import_fast, "import-fast", false, "")
+		fs.BoolVar(&opts.Disable_fk_checks, "disable-fk-checks", true, "")
+		fs.Func("rewrite-definer", "", func(value string) error {
+			opts.Rewrite_definer = &value
+			return nil
+		})
+		return fs, []string{"FILE", "TARGET", "DB"}
+	case "zip-all":
+		fs.StringVar(&opts.Zip_output_folder, "o", "", "")
+		fs.StringVar(&opts.Zip_output_folder, "out", "", "")
+		fs.IntVar(&opts.Jobs, "j", 1, "")
+		fs.Var((*StringList)(&opts.Exclude_db), "exclude-db", "")
+		fs.StringVar(&opts.Tmp_dir, "tmp-dir", "", "")
+		fs.IntVar(&opts.Rotate, "rotate", 0, "")
+		fs.BoolVar(&opts.Skip_space_check, "skip-space-check", false, "")
+		fs.BoolVar(&opts.Utc, "utc", false, "")
+		fs.StringVar(&opts.Time_format, "time-format", "", "")
+		fs.StringVar(&opts.Format, "format", opts.Format, "")
+		fs.IntVar(&opts.Zstd_level, "zstd-level", 0, "")
+		fs.StringVar(&opts.Archive_comment, "archive-comment", "", "")
+		fs.StringVar(&opts.Lock_mode, "lock-mode", opts.Lock_mode, "")
+		fs.BoolVar(&opts.Consistent, "consistent", false, "")
+		fs.StringVar(&opts.Label, "label", "", "")
+		return fs, []string{"SERVER"}
+	case "tables":
+		fs.IntVar(&opts.Top, "top", 0, "")
+		fs.StringVar(&opts.Output, "output", opts.Output, "")
+		return fs, []string{"SERVER", "DB"}
+	case "estimate":
+		fs.BoolFunc("i", "", disableEmptyTables)
+		return fs, []string{"SERVER", "DB"}
+	case "verify":
+		fs.BoolFunc("i", "", disableEmptyTables)
+		return fs, []string{"SOURCE", "TARGET", "DB"}
+	case "versions":
+		fs.StringVar(&opts.Dumper, "dumper", opts.Dumper, "")
+		fs.StringVar(&opts.Output, "output", opts.Output, "")
+		return fs, []string{"SERVER"}
 	}
 
-	_, err = sql.Exec(fmt.Sprintf("CREATE DATABASE %s", dbName))
+	return fs, []string{}
+}
 
-	if err != nil {
-		return err
+/* Parses COMMAND POSITIONAL ARGS [FLAGS] into dbdump.Options. Flags may appear before, between or after the positional arguments */
+func parseArgs(args []string) (dbdump.Options, error) {
+	opts := dbdump.Options{
+		Use_empty_tables: true,
+		Dumper:           "mysqldump",
+		Format:           "zip",
+		On_exists:        "drop",
+		Gtid_purged:      "OFF",
+		Lock_mode:        "transaction",
+		Webhook_on:       "always",
+		Config_format:    "json",
+		Output:           "table",
 	}
 
-	return nil
-}
+	if len(args) < 1 {
+		return opts, fmt.Errorf("missing command")
+	}
 
-func ReplicateTablesWithData(source Connection, target Connection, sourceDB string, targetDB string) error {
-	c1 := GetDumpCommand(source, sourceDB, true)
-	c2 := GetMysqlCommand(target, targetDB)
+	opts.Command = args[0]
 
-	err := PipeCommands(c1, c2)
+	fs, names := NewFlagSet(opts.Command, &opts)
 
-	if err != nil {
-		return err
-	}
+	positionals := []string{}
+	rest := args[1:]
 
-	return nil
-}
+	for {
+		err := fs.Parse(rest)
 
-func ReplicateTablesWithoutData(source Connection, target Connection, sourceDB string, targetDB string) error {
-	c1 := GetDumpCommand(source, sourceDB, false)
-	c2 := GetMysqlCommand(target, targetDB)
+		if err != nil {
+			return opts, err
+		}
 
-	err := PipeCommands(c1, c2)
+		if fs.NArg() == 0 {
+			break
+		}
 
-	if err != nil {
-		return err
+		positionals = append(positionals, fs.Arg(0))
+		rest = fs.Args()[1:]
 	}
 
-	return nil
-}
-
-func CleanTargetDatabase(connection Connection, target string) error {
-	sql, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:3306)/", connection.User, connection.Password, connection.Ip))
+	if len(positionals) < len(names) {
+		return opts, fmt.Errorf("missing argument %s", names[len(positionals)])
+	}
 
-	if err != nil {
-		return err
+	if len(positionals) > len(names) {
+		return opts, fmt.Errorf("unexpected argument '%s'", positionals[len(names)])
 	}
 
-	_, err = sql.Exec(fmt.Sprintf("USE %s", target))
+	opts.Source = positionals[0]
 
-	if err != nil {
-		return err
+	if len(names) == 3 {
+		opts.Target = positionals[1]
+		opts.Db = positionals[2]
+	} else if len(names) == 2 && names[1] == "TARGET" {
+		opts.Target = positionals[1]
+	} else if len(names) == 2 {
+		opts.Db = positionals[1]
 	}
 
-	for _, query := range CONFIG.Post_process_queries {
-		_, err = sql.Exec(query)
+	if opts.Command == "restore" {
+		opts.Restore_file, opts.Source = opts.Source, ""
+	}
 
-		if err != nil {
-			return err
+	/* The dump is written to a plain sql file instead of being imported */
+	if path, found := strings.CutPrefix(opts.Target, "file:"); found && opts.Command == "copy" {
+		if path == "" {
+			return opts, fmt.Errorf("missing the path of the file: target")
 		}
+
+		opts.Target, opts.Sql_file = "file", path
 	}
 
-	return nil
-}
+	/* Every database of the server goes to its own archive */
+	if opts.Command == "zip-all" {
+		opts.Target = "zip"
 
-func ReplicateDatabase(source Connection, target Connection, sourceDB string, targetDB string) error {
-	fmt.Printf("  %s:%s ━━━▶ %s:%s\n", source.Name, sourceDB, target.Name, targetDB)
+		if opts.Zip_output_folder == "" {
+			return opts, fmt.Errorf("missing --out")
+		}
 
-	start := time.Now()
+		if opts.Jobs < 1 {
+			return opts, fmt.Errorf("invalid -j value '%d'", opts.Jobs)
+		}
+	}
 
-	/* Replicate source database onto target database, ignoring some tables */
-	fmt.Print("  ┗━ Creating target database ...")
-	err := CreateTargetDatabase(target, targetDB)
-	if err != nil {
-		fmt.Print("\r  ┗━ Creating target database ... ✖\n\n")
-		return err
+	if opts.Config_format != "json" {
+		return opts, fmt.Errorf("invalid --config-format value '%s', only json is supported", opts.Config_format)
 	}
-	fmt.Print("\r  ┣━ Creating target database ... ✔\n")
 
-	/* Replicate source database onto target database, ignoring some tables */
-	fmt.Print("  ┗━ Replicating tables with data ...")
-	err = ReplicateTablesWithData(source, target, sourceDB, targetDB)
-	if err != nil {
-		fmt.Print("\r  ┗━ Replicating tables with data ... ✖\n\n")
-		return err
+	/* stdin can only be read once */
+	if index := slices.Index(opts.Config_files, "-"); index != -1 && slices.Contains(opts.Config_files[index+1:], "-") {
+		return opts, fmt.Errorf("--config - can only be given once")
 	}
-	fmt.Print("\r  ┣━ Replicating tables with data ... ✔\n")
 
-	/* Replicate schema for the ignored tables on the previous step */
-	fmt.Print("  ┗━ Replicating tables without data ...")
-	err = ReplicateTablesWithoutData(source, target, sourceDB, targetDB)
-	if err != nil {
-		fmt.Print("\r  ┗━ Replicating tables without data ... ✖\n\n")
-		return err
+	if !slices.Contains([]string{"drop", "fail", "truncate"}, opts.On_exists) {
+		return opts, fmt.Errorf("invalid --on-exists value '%s'", opts.On_exists)
 	}
-	fmt.Print("\r  ┣━ Replicating tables without data ... ✔\n")
 
-	if USE_EMPTY_TABLES_ARG {
-		/* Clear user data */
-		fmt.Print("  ┗━ Clear user data ...")
-		err = CleanTargetDatabase(target, targetDB)
-		if err != nil {
-			fmt.Print("\r  ┗━ Clear user data ... ✖\n\n")
-			return err
-		}
-		fmt.Print("\r  ┣━ Clear user data ... ✔\n")
+	opts.Gtid_purged = strings.ToUpper(opts.Gtid_purged)
+
+	if !slices.Contains([]string{"OFF", "ON", "AUTO", "COMMENTED"}, opts.Gtid_purged) {
+		return opts, fmt.Errorf("invalid --gtid-purged value '%s'", opts.Gtid_purged)
 	}
 
-	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
-	fmt.Printf("\r  ┗━ Done in %sm\n\n", diff)
+	if !slices.Contains([]string{"zip", "targz", "zstd"}, opts.Format) {
+		return opts, fmt.Errorf("invalid --format value '%s'", opts.Format)
+	}
 
-	return nil
-}
+	if opts.Zstd_level < 0 || opts.Zstd_level > 22 {
+		return opts, fmt.Errorf("invalid --zstd-level value '%d'", opts.Zstd_level)
+	}
 
-func RunBulk() error {
-	sourceIndex := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
-		return c.Name == SOURCE_ARG
-	})
+	if opts.Zstd_level > 0 && opts.Format != "zstd" {
+		return opts, fmt.Errorf("--zstd-level requires --format zstd")
+	}
 
-	if sourceIndex == -1 {
-		return fmt.Errorf("source '%s' not found in config file", SOURCE_ARG)
+	if opts.Label != "" && !dbdump.LABEL_REGEXP.MatchString(opts.Label) {
+		return opts, fmt.Errorf("invalid --label value '%s', only letters, digits, '_', '.' and '-' are allowed", opts.Label)
 	}
 
-	source := CONFIG.Servers[sourceIndex]
+	if opts.Webhook_on != "always" && opts.Webhook_on != "failure" {
+		return opts, fmt.Errorf("invalid --webhook-on value '%s'", opts.Webhook_on)
+	}
 
-	targetIndex := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
-		return c.Name == TARGET_ARG
-	})
+	if opts.Dumper != "mysqldump" && opts.Dumper != "mysqlpump" {
+		return opts, fmt.Errorf("invalid --dumper value '%s'", opts.Dumper)
+	}
 
-	if sourceIndex == -1 {
-		return fmt.Errorf("source '%s' not found in config file", SOURCE_ARG)
+	if opts.Threads < 0 {
+		return opts, fmt.Errorf("invalid --threads value '%d'", opts.Threads)
 	}
 
-	target := CONFIG.Servers[targetIndex]
+	if opts.Threads > 0 && opts.Dumper != "mysqlpump" && !opts.Fast_load {
+		return opts, fmt.Errorf("--threads requires --dumper mysqlpump or --fast-load")
+	}
 
-	start := time.Now()
+	if opts.Fast_load && (opts.Target == "zip" || opts.Dumper != "mysqldump" || opts.Filter != "" || opts.Dump_master_data) {
+		return opts, fmt.Errorf("--fast-load can't be used with zip targets, --dumper mysqlpump, --filter or --dump-master-data")
+	}
 
-	fmt.Println("\nStart bulk dump")
+	if !slices.Contains([]string{"transaction", "tables", "none"}, opts.Lock_mode) {
+		return opts, fmt.Errorf("invalid --lock-mode value '%s'", opts.Lock_mode)
+	}
 
-	counter := 0
+	if opts.Lock_mode != "transaction" && opts.Dumper != "mysqldump" {
+		return opts, fmt.Errorf("--lock-mode %s requires --dumper mysqldump", opts.Lock_mode)
+	}
 
-	for _, transaction := range CONFIG.Transactions {
-		err := ReplicateDatabase(source, target, transaction[0], transaction[1])
+	if opts.Flush_logs && opts.Dumper != "mysqldump" {
+		return opts, fmt.Errorf("--flush-logs requires --dumper mysqldump")
+	}
 
-		if err != nil {
-			fmt.Println(err.Error())
-			break
-		}
+	if opts.No_tz_utc && opts.Dumper != "mysqldump" {
+		return opts, fmt.Errorf("--no-tz-utc requires --dumper mysqldump")
+	}
 
-		counter++
+	if opts.Tablespaces && opts.Dumper != "mysqldump" {
+		return opts, fmt.Errorf("--include-tablespaces requires --dumper mysqldump")
 	}
 
-	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
-	fmt.Printf("%d databases done in %sm\n", counter, diff)
+	if opts.Exact && (opts.Dumper != "mysqldump" || opts.Fast_load) {
+		return opts, fmt.Errorf("--exact requires --dumper mysqldump and can't be used with --fast-load")
+	}
 
-	return nil
-}
+	if opts.Source_charset != "" && !dbdump.CHARSET_REGEXP.MatchString(opts.Source_charset) {
+		return opts, fmt.Errorf("invalid --source-charset value '%s', only letters, digits and '_' are allowed", opts.Source_charset)
+	}
 
-func CopyToZip() error {
-	USE_EMPTY_TABLES_ARG = false
+	if opts.Exact && opts.Source_charset != "" {
+		return opts, fmt.Errorf("--exact and --source-charset can't be used together")
+	}
 
-	sourceIndex := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
-		return c.Name == SOURCE_ARG
-	})
+	if opts.Retry_db < 0 {
+		return opts, fmt.Errorf("invalid --retry-db value '%d'", opts.Retry_db)
+	}
 
-	if sourceIndex == -1 {
-		return fmt.Errorf("source '%s' not found in config file", SOURCE_ARG)
+	if opts.Rotate < 0 {
+		return opts, fmt.Errorf("invalid --rotate value '%d'", opts.Rotate)
 	}
 
-	source := CONFIG.Servers[sourceIndex]
+	if opts.Rotate > 0 && opts.Target != "zip" {
+		return opts, fmt.Errorf("--rotate can only be used with zip targets")
+	}
 
-	start := time.Now()
-	fmt.Printf("Zipping %s ...", DB_ARG)
+	if opts.Rewrite_definer != nil && opts.Target == "zip" {
+		return opts, fmt.Errorf("--rewrite-definer can't be used with zip targets")
+	}
 
-	/* Dump database to sql file */
-	dumpcommand := GetDumpCommand(source, DB_ARG, true)
+	if opts.Filter != "" && opts.Target == "zip" {
+		return opts, fmt.Errorf("--filter can't be used with zip targets")
+	}
 
-	zipFileName := fmt.Sprintf("%s_%s.sql", DB_ARG, time.Now().Format("2006_01_02_15_04_05"))
-	file, err := os.Create(zipFileName)
+	if opts.Merge != (len(opts.Tables) > 0) {
+		return opts, fmt.Errorf("--merge and --tables must be used together")
+	}
 
-	if err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n", DB_ARG)
-		return err
+	if opts.Merge && opts.Target == "zip" {
+		return opts, fmt.Errorf("--merge can't be used with zip targets")
 	}
 
-	defer file.Close()
+	if (opts.Target_charset != "" || opts.Target_collation != "") && opts.Target == "zip" {
+		return opts, fmt.Errorf("--target-charset and --target-collation can't be used with zip targets")
+	}
 
-	dumpcommand.Stdout = file
+	if opts.Also_zip && (opts.Target == "zip" || opts.Fast_load || opts.Only_changed || opts.Merge) {
+		return opts, fmt.Errorf("--also-zip can't be used with zip targets, --fast-load, --only-changed or --merge")
+	}
 
-	err = dumpcommand.Start()
+	if opts.Skip_schema_pass && (opts.Target == "zip" || !opts.Use_empty_tables || opts.Merge || (opts.On_exists != "truncate" && !opts.Only_changed)) {
+		return opts, fmt.Errorf("--skip-schema-pass needs a kept target database (--on-exists truncate or --only-changed) and can't be used with zip targets, -i or --merge")
+	}
 
-	if err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n\n", DB_ARG)
-		return err
+	if opts.Truncate_empty && !opts.Skip_schema_pass {
+		return opts, fmt.Errorf("--truncate-empty requires --skip-schema-pass")
 	}
 
-	dumpcommand.Wait()
+	if opts.Resume_from != "" && (opts.Target == "zip" || !dbdump.CanResume(opts) || opts.Also_zip) {
+		return opts, fmt.Errorf("--resume-from can't be used with zip targets, --dumper mysqlpump, --fast-load, --merge, --only-changed, --import-fast or --also-zip")
+	}
 
-	/* Create zip archive */
-	archive, err := os.Create(fmt.Sprintf("./%s", ZIPFILENAME_ARG))
+	if opts.Only_create_db && (opts.Target == "zip" || opts.Also_zip || opts.Merge || opts.Only_changed || opts.Resume_from != "") {
+		return opts, fmt.Errorf("--only-create-db can't be used with zip targets, --also-zip, --merge, --only-changed or --resume-from")
+	}
 
-	if err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n\n", DB_ARG)
-		return err
+	if opts.All_post && len(opts.Post_tags) == 0 {
+		return opts, fmt.Errorf("--all-post requires --post-tags")
 	}
 
-	defer archive.Close()
+	if len(opts.Post_tags) > 0 && opts.Target == "zip" {
+		return opts, fmt.Errorf("--post-tags can't be used with zip targets")
+	}
 
-	zipWriter := zip.NewWriter(archive)
+	if opts.Validate_stream && (opts.Target == "zip" || opts.Fast_load) {
+		return opts, fmt.Errorf("--validate-stream can't be used with zip targets or --fast-load")
+	}
 
-	// Register a custom Deflate compressor.
-	zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.BestCompression)
-	})
+	if opts.Max_table_size > 0 && opts.Target == "zip" {
+		return opts, fmt.Errorf("--max-table-size can't be used with zip targets")
+	}
 
-	/* Read sql file */
-	fileReader, err := os.Open(zipFileName)
+	if len(opts.Data_tables) > 0 && opts.Target == "zip" {
+		return opts, fmt.Errorf("--data-tables can't be used with zip targets")
+	}
 
-	if err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n\n", DB_ARG)
-		return err
+	if opts.Import_fast && opts.Target == "zip" {
+		return opts, fmt.Errorf("--import-fast can't be used with zip targets")
 	}
 
-	defer fileReader.Close()
+	if opts.Validate_queries && opts.Target == "zip" {
+		return opts, fmt.Errorf("--validate-queries can't be used with zip targets")
+	}
 
-	/* Copy sql file to zip archive */
-	archiveWriter, err := zipWriter.Create(zipFileName)
+	if opts.Post_dry_run && (opts.Target == "zip" || opts.Validate_queries) {
+		return opts, fmt.Errorf("--post-dry-run can't be used with zip targets or --validate-queries")
+	}
 
-	if err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n\n", DB_ARG)
-		return err
+	if opts.Check_import && opts.Target == "zip" {
+		return opts, fmt.Errorf("--check-import can't be used with zip targets")
 	}
 
-	if _, err := io.Copy(archiveWriter, fileReader); err != nil {
-		fmt.Printf("\rZipping %s ... ✖.\n\n", DB_ARG)
-		return err
+	/* Nothing is imported into a server, so the flags acting on the import don't apply */
+	if opts.Target == "file" {
+		for _, flag := range []struct {
+			name string
+			set  bool
+		}{
+			{"--fast-load", opts.Fast_load},
+			{"--filter", opts.Filter != ""},
+			{"--rewrite-definer", opts.Rewrite_definer != nil},
+			{"--merge", opts.Merge},
+			{"--target-charset", opts.Target_charset != ""},
+			{"--target-collation", opts.Target_collation != ""},
+			{"--also-zip", opts.Also_zip},
+			{"--skip-schema-pass", opts.Skip_schema_pass},
+			{"--resume-from", opts.Resume_from != ""},
+			{"--only-create-db", opts.Only_create_db},
+			{"--validate-stream", opts.Validate_stream},
+			{"--max-table-size", opts.Max_table_size > 0},
+			{"--data-tables", len(opts.Data_tables) > 0},
+			{"--validate-queries", opts.Validate_queries},
+			{"--post-dry-run", opts.Post_dry_run},
+			{"--only-changed", opts.Only_changed},
+			{"--check-import", opts.Check_import},
+		} {
+			if flag.set {
+				return opts, fmt.Errorf("%s can't be used with file targets", flag.name)
+			}
+		}
 	}
 
-	zipWriter.Close()
+	if opts.Only_changed && opts.Target == "zip" {
+		return opts, fmt.Errorf("--only-changed can't be used with zip targets")
+	}
 
-	os.Remove(zipFileName)
+	if opts.Only_changed && opts.On_exists != "drop" {
+		return opts, fmt.Errorf("--only-changed can't be used with --on-exists")
+	}
 
-	diff := time.Time{}.Add(time.Since(start)).Format("04:05")
-	fmt.Printf("\rZipping %s ... ✔. Elapsed time: %sm\n\n", DB_ARG, diff)
+	if opts.Insert_ignore && opts.Replace {
+		return opts, fmt.Errorf("--insert-ignore and --replace can't be used together")
+	}
 
-	return nil
-}
+	if !slices.Contains([]string{"json", "table", "csv"}, opts.Output) {
+		return opts, fmt.Errorf("invalid --output value '%s'", opts.Output)
+	}
 
-func CopyToDb() error {
-	sourceIndex := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
-		return c.Name == SOURCE_ARG
-	})
+	if opts.Top < 0 {
+		return opts, fmt.Errorf("invalid --top value '%d'", opts.Top)
+	}
 
-	if sourceIndex == -1 {
-		return fmt.Errorf("source '%s' not found in config file", SOURCE_ARG)
+	if opts.Health_ttl < 0 {
+		return opts, fmt.Errorf("invalid --health-ttl value '%s'", opts.Health_ttl)
 	}
 
-	source := CONFIG.Servers[sourceIndex]
+	if opts.Max_runtime < 0 {
+		return opts, fmt.Errorf("invalid --max-runtime value '%s'", opts.Max_runtime)
+	}
 
-	targetIndex := slices.IndexFunc(CONFIG.Servers, func(c Connection) bool {
-		return c.Name == TARGET_ARG
-	})
+	return opts, nil
+}
 
-	if targetIndex == -1 {
-		return fmt.Errorf("source '%s' not found in config file", SOURCE_ARG)
+func ShowHelp(command string) {
+	if command == "copy" {
+		HelpCopy()
+	} else if command == "copy-routines" {
+		HelpCopyRoutines()
+	} else if command == "migrate-schema" {
+		HelpMigrateSchema()
+	} else if command == "restore" {
+		HelpRestore()
+	} else if command == "zip-all" {
+		HelpZipAll()
+	} else if command == "bulk" {
+		HelpBulk()
+	} else if command == "tables" {
+		HelpTables()
+	} else if command == "estimate" {
+		HelpEstimate()
+	} else if command == "verify" {
+		HelpVerify()
+	} else if command == "versions" {
+		HelpVersions()
+	} else {
+		HelpDump()
 	}
+}
 
-	target := CONFIG.Servers[targetIndex]
+/* Prints the final line of a copy, as json when requested. It is printed even in quiet mode */
+func PrintCopySummary(opts dbdump.Options, summary dbdump.CopySummary) {
+	if opts.Json {
+		data, _ := json.Marshal(summary)
+		fmt.Println(string(data))
+		return
+	}
 
-	err := ReplicateDatabase(source, target, DB_ARG, DB_ARG)
+	status := "done"
 
-	if err != nil {
-		return err
+	if !summary.Success {
+		status = "failed"
 	}
 
-	return nil
+	diff := time.Time{}.Add(time.Duration(summary.Elapsed * float64(time.Second))).Format("04:05")
+	fmt.Printf("Copy of %s to %s %s in %sm%s\n", summary.Database, summary.Direction, status, diff, dbdump.GetLabelNote(opts))
 }
 
-func RunCopy() error {
-	if TARGET_ARG == "zip" {
-		return CopyToZip()
-	} else {
-		return CopyToDb()
+/* Exit codes of the CLI */
+const (
+	EXIT_OK      = 0
+	EXIT_RUNTIME = 1
+	EXIT_CONFIG  = 2
+	EXIT_PARTIAL = 3
+)
+
+/* Config and usage errors can't be fixed by retrying, so they have their own exit code */
+func GetExitCode(err error) int {
+	if errors.As(err, &dbdump.ConfigError{}) {
+		return EXIT_CONFIG
 	}
-}
 
-func HelpDump() {
-	fmt.Println("Usage: dump [COMMAND] [POSITIONAL ARGS] [FLAGS]")
-	fmt.Println("")
-	fmt.Println("Commands: bulk, copy")
-	fmt.Println("")
-	fmt.Println("Flags:")
-	fmt.Println("  -h       Show help for the command")
+	return EXIT_RUNTIME
 }
 
-func HelpCopy() {
-	fmt.Println("Usage: copy SOURCE TARGET DB [FLAGS]")
-	fmt.Println("       copy SOURCE zip DB [FLAGS]")
-	fmt.Println("")
-	fmt.Println("Arguments:")
-	fmt.Println("  SOURCE   Name of the source database")
-	fmt.Println("  TARGET   Name of the target database or zip")
-	fmt.Println("  DB       Name of the database to dump")
-	fmt.Println("")
-	fmt.Println("Flags:")
-	fmt.Println("  -h       Show this help")
-	fmt.Println("  -i       Performs full dump ignoring post-cleanup queries and empty-tables configuration")
-	fmt.Println("  -f       Filename for the generated zip")
+func Fail(err error) int {
+	fmt.Println(err)
+	return GetExitCode(err)
 }
 
-func HelpBulk() {
-	fmt.Println("Usage: bulk SOURCE TARGET [FLAGS]")
-	fmt.Println("")
-	fmt.Println("Arguments:")
-	fmt.Println("  SOURCE   Name of the source database")
-	fmt.Println("  TARGET   Name of the target database")
-	fmt.Println("")
-	fmt.Println("Flags:")
-	fmt.Println("  -h       Show this help")
-	fmt.Println("  -i       Performs full dump ignoring post-cleanup queries and empty-tables configuration")
+func main() {
+	os.Exit(run())
 }
 
-func main() {
-	if len(os.Args) < 2 || (os.Args[1] != "bulk" && os.Args[1] != "copy") {
+func run() int {
+	if len(os.Args) < 2 || !slices.Contains([]string{"bulk", "copy", "copy-routines", "migrate-schema", "restore", "zip-all", "tables", "estimate", "verify", "versions"}, os.Args[1]) {
 		HelpDump()
-		return
-	}
-
-	command := os.Args[1]
 
-	if len(os.Args) == 3 && (os.Args[1] == "--help" || os.Args[1] == "-h") {
-		if command == "copy" {
-			HelpCopy()
-			return
-		} else if command == "bulk" {
-			HelpBulk()
-			return
-		} else {
-			HelpDump()
-			return
+		if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" {
+			return EXIT_OK
 		}
+
+		return EXIT_CONFIG
 	}
 
-	file := "config.json"
+	command := os.Args[1]
+
+	opts, err := parseArgs(os.Args[1:])
 
-	data, err := os.ReadFile(file)
+	if errors.Is(err, flag.ErrHelp) {
+		ShowHelp(command)
+		return EXIT_OK
+	}
 
 	if err != nil {
-		fmt.Print(err)
-		return
+		fmt.Println(err)
+		fmt.Printf("Run 'dump %s -h' for usage\n", command)
+		return EXIT_CONFIG
+	}
+
+	if len(opts.Config_files) == 0 {
+		opts.Config_files = []string{"config.json"}
 	}
 
-	err = json.Unmarshal(data, &CONFIG)
+	config, err := dbdump.LoadConfig(opts.Config_files)
 
 	if err != nil {
-		fmt.Print(err)
-		return
+		return Fail(err)
 	}
 
-	if len(os.Args) < 4 {
-		HelpDump()
-		return
-	}
+	if opts.Print_config {
+		err = dbdump.PrintConfig(config, opts, os.Stdout)
 
-	SOURCE_ARG = os.Args[2]
-	TARGET_ARG = os.Args[3]
+		if err != nil {
+			return Fail(err)
+		}
 
-	if len(os.Args) == 5 {
-		DB_ARG = os.Args[4]
+		return EXIT_OK
 	}
 
-	ZIPFILENAME_ARG = fmt.Sprintf("%s_%s.zip", DB_ARG, time.Now().Format("2006_01_02_15_04_05"))
+	dbdump.PRINTER.Quiet = opts.Quiet || opts.Json
 
-	fileFlag := false
+	if command == "bulk" {
+		summary, err := dbdump.Bulk(config, opts)
 
-	for _, arg := range os.Args[4:] {
-		if fileFlag {
-			ZIPFILENAME_ARG = arg
-			break
+		if err != nil {
+			return Fail(err)
 		}
 
-		if arg == "-i" {
-			USE_EMPTY_TABLES_ARG = false
-		} else if arg == "-f" || arg == "--file" {
-			fileFlag = true
+		/* Some databases were copied before the run stopped */
+		if summary.Databases < summary.Total {
+			if summary.Databases > 0 {
+				return EXIT_PARTIAL
+			}
+
+			return EXIT_RUNTIME
 		}
+
+		return EXIT_OK
 	}
 
-	if command == "bulk" {
-		err = RunBulk()
+	if command == "zip-all" {
+		summary, err := dbdump.ZipAll(config, opts)
 
 		if err != nil {
-			fmt.Println(err)
+			return Fail(err)
 		}
+
+		/* The failed databases are listed in the summary and the manifest */
+		if summary.Databases < summary.Total {
+			if summary.Databases > 0 {
+				return EXIT_PARTIAL
+			}
+
+			return EXIT_RUNTIME
+		}
+
+		return EXIT_OK
+	}
+
+	if command == "copy-routines" {
+		err = dbdump.CopyRoutines(config, opts)
+	} else if command == "restore" {
+		err = dbdump.Restore(config, opts)
+	} else if command == "copy" && opts.Explain {
+		err = dbdump.Explain(config, opts)
 	} else if command == "copy" {
-		err = RunCopy()
+		summary, err := dbdump.Copy(config, opts)
+
+		PrintCopySummary(opts, summary)
+
+		if err == nil {
+			return EXIT_OK
+		}
+
+		/* The json summary already carries the error */
+		if opts.Json {
+			return GetExitCode(err)
+		}
+
+		return Fail(err)
+	} else {
+		opts, err = dbdump.Setup(config, opts)
 
 		if err != nil {
-			fmt.Println(err)
+			return Fail(err)
+		}
+
+		if command == "tables" {
+			err = dbdump.RunTables(opts)
+		} else if command == "estimate" {
+			err = dbdump.RunEstimate(opts)
+		} else if command == "verify" {
+			err = dbdump.RunVerify(opts)
+		} else if command == "versions" {
+			err = dbdump.RunVersions(opts)
+		} else if command == "migrate-schema" {
+			err = dbdump.RunMigrateSchema(opts)
 		}
 	}
+
+	if err != nil {
+		return Fail(err)
+	}
+
+	return EXIT_OK
 }